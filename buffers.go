@@ -0,0 +1,468 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// buffer holds one file being edited. The buffer being shown lives in the
+// globals the rest of the editor works on; the others keep their state
+// here until they are switched to.
+type buffer struct {
+	number   int
+	filename string
+	loaded   bool // whether the file has been read yet
+
+	top         *line
+	topOfScreen *line
+	currentLine *line
+	lineno      int
+	textX       int
+	leftCol     int
+	numLines    int
+	lineGen     int
+
+	undoStack  []undoState
+	redoStack  []undoState
+	marks      map[byte]mark
+	changeTick int
+	savedTick  int
+
+	diskStamp   fileStamp
+	warnedStamp fileStamp
+	warned      bool
+
+	fileFormat   string
+	fileEncoding string
+	readOnly     bool
+}
+
+// buffers is the buffer list in the order the buffers were opened. curBuf
+// is the one shown and altBuf the one shown before it, for Ctrl-^.
+var buffers []*buffer
+var curBuf *buffer
+var altBuf *buffer
+var nextBufferNumber = 1
+
+// argList is the files named on the command line, with argIndex the one
+// :next and :previous last went to
+var argList []string
+var argIndex int
+
+func newBuffer(name string) *buffer {
+	b := &buffer{number: nextBufferNumber, filename: name}
+	nextBufferNumber++
+	buffers = append(buffers, b)
+	return b
+}
+
+// stash copies the state of the buffer being shown into b
+func (b *buffer) stash() {
+	b.filename = filename
+	b.top, b.topOfScreen, b.currentLine = top, topOfScreen, currentLine
+	b.lineno, b.textX, b.leftCol = lineno, textX, leftCol
+	b.numLines, b.lineGen = numLines, lineGen
+	b.undoStack, b.redoStack = undoStack, redoStack
+	b.marks = marks
+	b.changeTick, b.savedTick = changeTick, savedTick
+	b.diskStamp, b.warnedStamp, b.warned = diskStamp, warnedStamp, warned
+	b.fileFormat, b.fileEncoding, b.readOnly = fileFormat, fileEncoding, readOnly
+}
+
+// unstash makes b the buffer the editor works on
+func (b *buffer) unstash() {
+	filename = b.filename
+	top, topOfScreen, currentLine = b.top, b.topOfScreen, b.currentLine
+	lineno, textX, leftCol = b.lineno, b.textX, b.leftCol
+	numLines, lineGen = b.numLines, b.lineGen
+	undoStack, redoStack = b.undoStack, b.redoStack
+	marks = b.marks
+	changeTick, savedTick = b.changeTick, b.savedTick
+	diskStamp, warnedStamp, warned = b.diskStamp, b.warnedStamp, b.warned
+	fileFormat, fileEncoding, readOnly = b.fileFormat, b.fileEncoding, b.readOnly
+}
+
+// enterBuffer shows b in place of the current buffer, reading its file if
+// that has not been done yet, and returns a description of it
+func enterBuffer(b *buffer) (string, error) {
+	if curBuf != nil && curBuf != b {
+		curBuf.stash()
+		altBuf = curBuf
+	}
+	curBuf = b
+	if curWin != nil {
+		curWin.buf = b
+	}
+	b.unstash()
+	if b.loaded {
+		fixView()
+		return bufferInfo(), nil
+	}
+	b.loaded = true
+	if filename == "" {
+		setBuffer(nil)
+		markSaved()
+		return bufferInfo(), nil
+	}
+	msg, err := loadFile(filename)
+	if err != nil {
+		setBuffer(nil)
+		markSaved()
+	}
+	return msg, err
+}
+
+// bufferInfo describes the current buffer the way CTRL-G does in vim
+func bufferInfo() string {
+	name := filename
+	if name == "" {
+		name = "[No Name]"
+	}
+	info := fmt.Sprintf("\"%s\"", name)
+	if isModified() {
+		info += " [Modified]"
+	}
+	return fmt.Sprintf("%s line %d of %d", info, lineno+1, lineCount())
+}
+
+// switchBuffer shows b, refusing to leave changes behind in the current
+// buffer unless forced
+func switchBuffer(b *buffer, force bool) error {
+	if b == curBuf {
+		return nil
+	}
+	if isModified() && !force {
+		return errModified
+	}
+	msg, err := enterBuffer(b)
+	redraw()
+	refresh(nil)
+	if err != nil {
+		return err
+	}
+	flash(msg)
+	return nil
+}
+
+// withBuffer runs f with b standing in for the current buffer
+func withBuffer(b *buffer, f func()) {
+	if b == curBuf {
+		f()
+		return
+	}
+	curBuf.stash()
+	b.unstash()
+	defer curBuf.unstash()
+	defer b.stash()
+	f()
+}
+
+func bufferIndex(b *buffer) int {
+	for i, other := range buffers {
+		if other == b {
+			return i
+		}
+	}
+	return -1
+}
+
+func bufferModified(b *buffer) bool {
+	changed := false
+	withBuffer(b, func() {
+		changed = b.loaded && isModified()
+	})
+	return changed
+}
+
+func bufferName(b *buffer) string {
+	if b.filename == "" {
+		return "[No Name]"
+	}
+	return b.filename
+}
+
+// findFileBuffer finds the buffer editing the named file
+func findFileBuffer(name string) *buffer {
+	for _, b := range buffers {
+		if b.filename != "" && sameFile(b.filename, name) {
+			return b
+		}
+	}
+	return nil
+}
+
+// findBuffer finds a buffer by number, or by a name or part of one that
+// only one buffer matches
+func findBuffer(arg string) (*buffer, error) {
+	if n, err := strconv.Atoi(arg); err == nil {
+		for _, b := range buffers {
+			if b.number == n {
+				return b, nil
+			}
+		}
+		return nil, fmt.Errorf("buffer %d does not exist", n)
+	}
+	if b := findFileBuffer(arg); b != nil {
+		return b, nil
+	}
+	var found *buffer
+	for _, b := range buffers {
+		if strings.Contains(b.filename, arg) {
+			if found != nil {
+				return nil, fmt.Errorf("more than one match for %s", arg)
+			}
+			found = b
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no matching buffer for %s", arg)
+	}
+	return found, nil
+}
+
+// editFile shows the buffer for the named file, opening a new one for it
+// if there is none
+func editFile(name string, force bool) error {
+	b := findFileBuffer(name)
+	if b == nil {
+		if isModified() && !force {
+			return errModified
+		}
+		b = newBuffer(name)
+	}
+	return switchBuffer(b, force)
+}
+
+// exBuffer is :b N or :b name
+func exBuffer(ex *exArgs) error {
+	if ex.arg == "" {
+		flash(bufferInfo())
+		return nil
+	}
+	b, err := findBuffer(ex.arg)
+	if err != nil {
+		return err
+	}
+	return switchBuffer(b, ex.bang)
+}
+
+// exBufferNext is :bnext, and :bprevious going the other way
+func exBufferNext(ex *exArgs) error {
+	step := 1
+	if ex.cmd.name != "bnext" {
+		step = -1
+	}
+	count := 1
+	if ex.arg != "" {
+		n, err := strconv.Atoi(ex.arg)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid argument: %s", ex.arg)
+		}
+		count = n
+	}
+	i := bufferIndex(curBuf) + step*count
+	i = (i%len(buffers) + len(buffers)) % len(buffers)
+	return switchBuffer(buffers[i], ex.bang)
+}
+
+// exBufferDelete is :bd, taking the current buffer or the one named off
+// the list
+func exBufferDelete(ex *exArgs) error {
+	b := curBuf
+	if ex.arg != "" {
+		var err error
+		if b, err = findBuffer(ex.arg); err != nil {
+			return err
+		}
+	}
+	if bufferModified(b) && !ex.bang {
+		return fmt.Errorf("no write since last change for buffer %d (add ! to override)", b.number)
+	}
+	i := bufferIndex(b)
+	next := altBuf
+	if next == nil || next == b {
+		next = buffers[(i+1)%len(buffers)]
+	}
+	if next == b {
+		next = newBuffer("")
+	}
+	for _, w := range windowList() {
+		if w.buf == b && windowCount() > 1 {
+			closeWindow(w) //nolint
+		}
+	}
+	// windows left showing b, here or in other tab pages, show next instead
+	for _, w := range allWindows() {
+		if w.buf != b {
+			continue
+		}
+		if w != curWin {
+			w.buf = next
+			continue
+		}
+		if _, err := enterBuffer(next); err != nil {
+			flash(err.Error())
+		}
+		redraw()
+		refresh(nil)
+	}
+	buffers = append(buffers[:i], buffers[i+1:]...)
+	if altBuf == b {
+		altBuf = nil
+	}
+	return nil
+}
+
+// exBufferList is :ls, listing the buffers with % marking the current one,
+// # the alternate and + those with changes
+func exBufferList(ex *exArgs) error {
+	curBuf.stash()
+	for _, b := range buffers {
+		flag := ' '
+		if b == curBuf {
+			flag = '%'
+		} else if b == altBuf {
+			flag = '#'
+		}
+		state := ' '
+		if b == curBuf {
+			state = 'a'
+		} else if b.loaded {
+			state = 'h'
+		}
+		changed := ' '
+		if bufferModified(b) {
+			changed = '+'
+		}
+		name := fmt.Sprintf("\"%s\"", bufferName(b))
+		report(fmt.Sprintf("%3d %c%c %c %-30s line %d", b.number, flag, state, changed, name, b.lineno+1))
+	}
+	return nil
+}
+
+// alternateBuffer is Ctrl-^, going back to the buffer shown before
+func alternateBuffer() {
+	if altBuf == nil || bufferIndex(altBuf) < 0 {
+		flash("no alternate file")
+		return
+	}
+	if err := switchBuffer(altBuf, false); err != nil {
+		flash(err.Error())
+	}
+}
+
+// exNext is :next, and :previous going the other way, through the files
+// given on the command line
+func exNext(ex *exArgs) error {
+	if len(argList) == 0 {
+		return errors.New("there is no argument list")
+	}
+	i := argIndex + 1
+	if ex.cmd.name != "next" {
+		i = argIndex - 1
+	}
+	if i >= len(argList) {
+		return errors.New("cannot go beyond last file")
+	}
+	if i < 0 {
+		return errors.New("cannot go before first file")
+	}
+	if err := editFile(argList[i], ex.bang); err != nil {
+		return err
+	}
+	argIndex = i
+	return nil
+}
+
+// exArgList lists the argument list with the current file in brackets
+func exArgList(ex *exArgs) error {
+	var names []string
+	for i, name := range argList {
+		if i == argIndex {
+			name = "[" + name + "]"
+		}
+		names = append(names, name)
+	}
+	report(strings.Join(names, " "))
+	return nil
+}
+
+// exWriteAll is :wa, writing every changed buffer that has a name, and
+// :wqa and :xa, which then quit
+func exWriteAll(ex *exArgs) error {
+	var failed error
+	for _, b := range buffers {
+		if !bufferModified(b) {
+			continue
+		}
+		if b.filename == "" {
+			failed = fmt.Errorf("no file name for buffer %d", b.number)
+			continue
+		}
+		withBuffer(b, func() {
+			if readOnly {
+				failed = fmt.Errorf("\"%s\" is read-only", filename)
+				return
+			}
+			if err := writeLines(filename, 0, lineCount()-1, false); err != nil {
+				failed = err
+				return
+			}
+			recordStamp(filename)
+			markSaved()
+		})
+	}
+	if failed != nil {
+		return failed
+	}
+	if ex.cmd.name != "wall" {
+		return quitIfSaved()
+	}
+	return nil
+}
+
+// exQuitAll is :qa, refusing while any buffer has changes unless forced
+func exQuitAll(ex *exArgs) error {
+	if ex.bang {
+		quit = true
+		return nil
+	}
+	return quitIfSaved()
+}
+
+// quitWindow closes the current window, refusing to leave changes in its
+// buffer behind, or quits when it is the last one of the last tab page
+func quitWindow() error {
+	if windowCount() == 1 && len(tabs) == 1 {
+		return quitIfSaved()
+	}
+	if isModified() && !bufferShown(curBuf, curWin) {
+		return errModified
+	}
+	return closeWindow(curWin)
+}
+
+// quitIfSaved quits unless some buffer has unsaved changes
+func quitIfSaved() error {
+	if err := checkAllSaved(); err != nil {
+		return err
+	}
+	quit = true
+	return nil
+}
+
+// checkAllSaved complains about the first buffer with unsaved changes,
+// starting with the current one
+func checkAllSaved() error {
+	if isModified() {
+		return errModified
+	}
+	for _, b := range buffers {
+		if bufferModified(b) {
+			return fmt.Errorf("no write since last change for buffer \"%s\" (add ! to override)", bufferName(b))
+		}
+	}
+	return nil
+}
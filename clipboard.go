@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// clipboardProvider connects the "+ and "* registers to a system
+// clipboard. The selection is '+' for the clipboard and '*' for the
+// primary selection.
+type clipboardProvider interface {
+	Get(selection byte) (string, error)
+	Set(selection byte, text string) error
+}
+
+// clipboard is the provider behind "+ and "*, chosen from the
+// 'clipboardread' and 'clipboardwrite' options when nil
+var clipboard clipboardProvider
+
+// osc52Clipboard writes the selection to the terminal with an OSC 52
+// escape sequence, which works across ssh and tmux. Terminals rarely
+// allow reading the clipboard back, so Get only returns what was last
+// set from this editor.
+type osc52Clipboard struct {
+	last map[byte]string
+}
+
+func (c *osc52Clipboard) Get(selection byte) (string, error) {
+	if text, ok := c.last[selection]; ok {
+		return text, nil
+	}
+	return "", fmt.Errorf("clipboard can not be read, set 'clipboardread'")
+}
+
+func (c *osc52Clipboard) Set(selection byte, text string) error {
+	if c.last == nil {
+		c.last = map[byte]string{}
+	}
+	c.last[selection] = text
+	target := "c"
+	if selection == '*' {
+		target = "p"
+	}
+	seq := fmt.Sprintf(
+		"\x1b]52;%s;%s\x07",
+		target,
+		base64.StdEncoding.EncodeToString([]byte(text)),
+	)
+	if os.Getenv("TMUX") != "" {
+		seq = "\x1bPtmux;" + strings.ReplaceAll(seq, "\x1b", "\x1b\x1b") + "\x1b\\"
+	}
+	fmt.Print(seq)
+	return nil
+}
+
+// commandClipboard runs external helpers such as xclip, wl-copy or
+// pbcopy. A command containing %s has it replaced by "clipboard" or
+// "primary" to pick the selection. An empty command falls back to the
+// next provider.
+type commandClipboard struct {
+	read     string
+	write    string
+	fallback clipboardProvider
+}
+
+func selectionName(selection byte) string {
+	if selection == '*' {
+		return "primary"
+	}
+	return "clipboard"
+}
+
+func shellCommand(command string, selection byte) *exec.Cmd {
+	command = strings.ReplaceAll(command, "%s", selectionName(selection))
+	return exec.Command("sh", "-c", command)
+}
+
+func (c *commandClipboard) Get(selection byte) (string, error) {
+	if c.read == "" {
+		return c.fallback.Get(selection)
+	}
+	var stderr bytes.Buffer
+	cmd := shellCommand(c.read, selection)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v %s", c.read, err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+func (c *commandClipboard) Set(selection byte, text string) error {
+	if c.write == "" {
+		return c.fallback.Set(selection, text)
+	}
+	var stderr bytes.Buffer
+	cmd := shellCommand(c.write, selection)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v %s", c.write, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+var osc52 = &osc52Clipboard{}
+
+func clipboardFor() clipboardProvider {
+	if clipboard != nil {
+		return clipboard
+	}
+	read := optString("clipboardread")
+	write := optString("clipboardwrite")
+	if read == "" && write == "" {
+		return osc52
+	}
+	return &commandClipboard{read: read, write: write, fallback: osc52}
+}
+
+// registerText flattens a register the way it is put on the clipboard,
+// with a trailing newline marking linewise text
+func registerText(reg *register) string {
+	text := strings.Join(reg.text, "\n")
+	if reg.kind == linewise {
+		text += "\n"
+	}
+	return text
+}
+
+func textRegister(text string) *register {
+	if strings.HasSuffix(text, "\n") {
+		return &register{
+			text: strings.Split(strings.TrimSuffix(text, "\n"), "\n"),
+			kind: linewise,
+		}
+	}
+	return &register{text: strings.Split(text, "\n"), kind: charwise}
+}
+
+func getClipboard(selection byte) *register {
+	text, err := clipboardFor().Get(selection)
+	if err != nil {
+		flash(err.Error())
+		return nil
+	}
+	return textRegister(strings.ReplaceAll(text, "\r\n", "\n"))
+}
+
+// setClipboard puts reg on the clipboard, reporting it when it can not
+func setClipboard(selection byte, reg *register) bool {
+	if err := clipboardFor().Set(selection, registerText(reg)); err != nil {
+		flash(err.Error())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// fakeClipboard keeps the selections in memory, failing with err when it
+// is set
+type fakeClipboard struct {
+	text map[byte]string
+	err  error
+}
+
+func (c *fakeClipboard) Get(selection byte) (string, error) {
+	if c.err != nil {
+		return "", c.err
+	}
+	return c.text[selection], nil
+}
+
+func (c *fakeClipboard) Set(selection byte, text string) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.text[selection] = text
+	return nil
+}
+
+func useFakeClipboard(t *testing.T) *fakeClipboard {
+	fake := &fakeClipboard{text: map[byte]string{}}
+	clipboard = fake
+	t.Cleanup(func() { clipboard = nil })
+	return fake
+}
+
+func TestClipboardRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		yank  string
+		put   string
+		clip  string
+		lines []string
+	}{
+		{
+			name:  "charwise",
+			yank:  "wv$\"+y",
+			put:   "0\"*p",
+			clip:  "world",
+			lines: []string{"hworldello world", "second"},
+		},
+		{
+			name:  "linewise",
+			yank:  "\"+yy",
+			put:   "j\"*p",
+			clip:  "hello world\n",
+			lines: []string{"hello world", "second", "hello world"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeClipboard(t)
+			startEditor([]string{"hello world", "second"})
+			typeKeys(tt.yank)
+			if got := fake.text['+']; got != tt.clip {
+				t.Fatalf("clipboard holds %q, want %q", got, tt.clip)
+			}
+			fake.text['*'] = fake.text['+']
+			typeKeys(tt.put)
+			if got := lineTexts(0, lineCount()-1); strings.Join(got, "\n") != strings.Join(tt.lines, "\n") {
+				t.Errorf("buffer is %q, want %q", got, tt.lines)
+			}
+		})
+	}
+}
+
+func TestClipboardError(t *testing.T) {
+	fake := useFakeClipboard(t)
+	startEditor([]string{"hello world", "second"})
+	typeKeys("yy")
+	fake.err = errors.New("no clipboard here")
+
+	typeKeys("j\"+yy")
+	if got := messageLine(); got != "no clipboard here" {
+		t.Errorf("message line is %q, want the clipboard error", got)
+	}
+	if reg := getRegister('"'); reg == nil || strings.Join(reg.text, "\n") != "hello world" {
+		t.Errorf("unnamed register changed to %v", reg)
+	}
+	if _, ok := registers['+']; ok {
+		t.Errorf("failed yank was stored in \"+")
+	}
+
+	typeKeys("\"*p")
+	if got := messageLine(); got != "no clipboard here" {
+		t.Errorf("message line is %q, want the clipboard error", got)
+	}
+	if got := lineTexts(0, lineCount()-1); len(got) != 2 || got[1] != "second" {
+		t.Errorf("failed put changed the buffer to %q", got)
+	}
+}
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// exCommand is an entry in the table of : commands
+type exCommand struct {
+	name  string // the full name
+	short int    // the length of the shortest abbreviation accepted
+	flags int
+	run   func(ex *exArgs) error
+}
+
+const (
+	exRange = 1 << iota // takes a range
+	exBang              // takes a ! after the name
+	exWhole             // the range defaults to the whole buffer
+	exZero              // address 0, before the first line, is allowed
+	exBar               // | is part of the argument instead of ending the command
+)
+
+// exArgs is one parsed : command. Lines are zero based, with -1 standing
+// for address 0 where the command allows it.
+type exArgs struct {
+	cmd   *exCommand
+	line1 int
+	line2 int
+	addrs int // how many addresses were given
+	bang  bool
+	arg   string
+	// next holds the commands following a |. An exBar command that finds
+	// the end of its own argument may set it.
+	next string
+}
+
+var exCommands []exCommand
+
+func init() {
+	exCommands = []exCommand{
+		{"args", 2, 0, exArgList},
+		{"buffer", 1, exBang, exBuffer},
+		{"buffers", 7, 0, exBufferList},
+		{"bNext", 2, exBang, exBufferNext},
+		{"bdelete", 2, exBang, exBufferDelete},
+		{"bnext", 2, exBang, exBufferNext},
+		{"bprevious", 2, exBang, exBufferNext},
+		{"delete", 1, exRange, exDelete},
+		{"edit", 1, exBang, exEdit},
+		{"files", 3, 0, exBufferList},
+		{"join", 1, exRange | exBang, exJoin},
+		{"move", 1, exRange, exMove},
+		{"print", 1, exRange, exPrint},
+		{"previous", 4, exBang, exNext},
+		{"Next", 1, exBang, exNext},
+		{"copy", 2, exRange, exCopy},
+		{"close", 3, exBang, exClose},
+		{"mark", 2, exRange, exMark},
+		{"marks", 5, 0, exMarks},
+		{"ls", 2, 0, exBufferList},
+		{"global", 1, exRange | exBang | exWhole | exBar, exGlobal},
+		{"next", 1, exBang, exNext},
+		{"normal", 4, exRange | exBang | exBar, exNormal},
+		{"number", 2, exRange, exPrint},
+		{"nohlsearch", 3, 0, exNohlsearch},
+		{"only", 2, exBang, exOnly},
+		{"quit", 1, exBang, exQuit},
+		{"qall", 2, exBang, exQuitAll},
+		{"quitall", 5, exBang, exQuitAll},
+		{"read", 1, exRange | exBang | exZero | exBar, exRead},
+		{"registers", 3, 0, exRegisters},
+		{"retab", 3, exRange | exBang | exWhole, exRetab},
+		{"display", 2, 0, exRegisters},
+		{"substitute", 1, exRange | exBar, exSubstitute},
+		{"set", 2, 0, exSet},
+		{"saveas", 3, exBang, exSaveas},
+		{"split", 2, 0, exSplit},
+		{"sort", 3, exRange | exBang | exWhole, exSort},
+		{"t", 1, exRange, exCopy},
+		{"tabnext", 4, 0, exTabnext},
+		{"tabNext", 4, 0, exTabnext},
+		{"tabprevious", 4, 0, exTabnext},
+		{"tabnew", 6, 0, exTabedit},
+		{"tabedit", 4, 0, exTabedit},
+		{"tabclose", 4, exBang, exTabclose},
+		{"tabonly", 4, exBang, exTabonly},
+		{"vglobal", 1, exRange | exWhole | exBar, exGlobal},
+		{"vsplit", 2, 0, exSplit},
+		{"write", 1, exRange | exBang | exWhole | exBar, exWrite},
+		{"wq", 2, exRange | exBang | exWhole | exBar, exWrite},
+		{"wall", 2, 0, exWriteAll},
+		{"wqall", 3, 0, exWriteAll},
+		{"xit", 1, exRange | exBang | exWhole | exBar, exWrite},
+		{"exit", 3, exRange | exBang | exWhole | exBar, exWrite},
+		{"xall", 2, 0, exWriteAll},
+		{"yank", 1, exRange, exYank},
+		{"!", 1, exRange | exBang | exBar, exShell},
+		{"#", 1, exRange, exPrint},
+		{"&", 1, exRange | exBar, exSubstitute},
+		{"<", 1, exRange, exShift},
+		{">", 1, exRange, exShift},
+		{"=", 1, exRange, exLineNumber},
+	}
+}
+
+// lookupCommand finds the command name is the full name or an
+// abbreviation of, the first in the table winning
+func lookupCommand(name string) *exCommand {
+	for i := range exCommands {
+		c := &exCommands[i]
+		if strings.HasPrefix(c.name, name) && len(name) >= c.short {
+			return c
+		}
+	}
+	return nil
+}
+
+func matchingCommands(prefix string) []string {
+	var names []string
+	for _, c := range exCommands {
+		if c.name[0] >= 'a' && c.name[0] <= 'z' {
+			names = append(names, c.name)
+		}
+	}
+	return withPrefix(names, prefix)
+}
+
+// exOutput collects what the commands on a command line list, to be shown
+// together once they have all run
+var exOutput []string
+
+func report(text string) {
+	exOutput = append(exOutput, text)
+}
+
+func execute(cmd string) {
+	exOutput = nil
+	err := runCommands(cmd)
+	showOutput(exOutput)
+	exOutput = nil
+	if err != nil {
+		flash(err.Error())
+	}
+}
+
+// runCommands executes a command line, one | separated command at a
+// time so that each sees the cursor as the one before left it
+func runCommands(text string) error {
+	for strings.TrimLeft(text, " \t:|") != "" {
+		ex, err := parseCommand(text)
+		if err != nil {
+			return err
+		}
+		if err := ex.exec(); err != nil {
+			return err
+		}
+		text = ex.next
+	}
+	return nil
+}
+
+func (ex *exArgs) exec() error {
+	if ex.cmd == nil {
+		if ex.addrs == 0 {
+			return nil
+		}
+		n := ex.line2
+		if count := lineCount(); n > count-1 {
+			n = count - 1
+		}
+		jumpTo(n)
+		firstNonBlank()
+		return nil
+	}
+	return ex.cmd.run(ex)
+}
+
+type exParser struct {
+	text string
+	pos  int
+}
+
+func (p *exParser) peek() byte {
+	if p.pos < len(p.text) {
+		return p.text[p.pos]
+	}
+	return 0
+}
+
+func (p *exParser) skipSpace() {
+	for p.peek() == ' ' || p.peek() == '\t' {
+		p.pos++
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func (p *exParser) number() int {
+	start := p.pos
+	for isDigit(p.peek()) {
+		p.pos++
+	}
+	n, _ := strconv.Atoi(p.text[start:p.pos])
+	return n
+}
+
+// parseCommand parses the first command of text, leaving the ones after
+// a | in next
+func parseCommand(text string) (*exArgs, error) {
+	p := &exParser{text: text}
+	for p.peek() == ':' || p.peek() == ' ' || p.peek() == '\t' {
+		p.pos++
+	}
+	ex := &exArgs{line1: lineno, line2: lineno}
+	if err := p.parseRange(ex); err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+	start := p.pos
+	if isLetter(p.peek()) {
+		for isLetter(p.peek()) {
+			p.pos++
+		}
+	} else if strings.IndexByte("!&<>=~#*@", p.peek()) >= 0 {
+		p.pos++
+	}
+	name := p.text[start:p.pos]
+	if name == "" {
+		p.skipSpace()
+		if p.peek() == '|' {
+			p.pos++
+		} else if p.pos < len(p.text) {
+			return nil, fmt.Errorf("trailing characters: %s", p.text[p.pos:])
+		}
+		ex.next = p.text[p.pos:]
+		return ex, checkRange(ex, 0)
+	}
+	ex.cmd = lookupCommand(name)
+	if ex.cmd == nil {
+		return nil, fmt.Errorf("not an editor command: %s", strings.TrimSpace(text))
+	}
+
+	if p.peek() == '!' {
+		if ex.cmd.flags&exBang == 0 {
+			return nil, errors.New("no ! allowed")
+		}
+		ex.bang = true
+		p.pos++
+	}
+	if ex.addrs > 0 && ex.cmd.flags&exRange == 0 {
+		return nil, errors.New("no range allowed")
+	}
+	if ex.addrs == 0 && ex.cmd.flags&exWhole != 0 {
+		ex.line1, ex.line2 = 0, lineCount()-1
+	}
+	if err := checkRange(ex, ex.cmd.flags); err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+	ex.arg = p.text[p.pos:]
+	if ex.cmd.flags&exBar == 0 {
+		ex.splitBar()
+	}
+	return ex, nil
+}
+
+// splitBar ends the argument at the first | not escaped with a backslash,
+// moving what follows to next. Commands that take | in their argument
+// call it themselves when it turns out not to be theirs.
+func (ex *exArgs) splitBar() {
+	var arg strings.Builder
+	text := ex.arg
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if c == '\\' && i+1 < len(text) && text[i+1] == '|' {
+			continue
+		}
+		if c == '|' && (i == 0 || text[i-1] != '\\') {
+			ex.next = text[i+1:]
+			break
+		}
+		arg.WriteByte(c)
+	}
+	ex.arg = strings.TrimRight(arg.String(), " \t")
+}
+
+// checkRange puts the lines of a range in order and makes sure they are
+// in the buffer
+func checkRange(ex *exArgs, flags int) error {
+	if ex.line1 > ex.line2 {
+		ex.line1, ex.line2 = ex.line2, ex.line1
+	}
+	low := 0
+	if flags&exZero != 0 || ex.cmd == nil {
+		low = -1
+	}
+	if ex.line1 < low || (ex.cmd != nil && ex.line2 > lineCount()-1) {
+		return errors.New("invalid range")
+	}
+	if ex.line1 < 0 && low == 0 {
+		ex.line1 = 0
+	}
+	return nil
+}
+
+// parseRange reads the addresses before a command name. Addresses are
+// separated by , or by ; which makes the first the line the second is
+// relative to. Only the last two count, and a missing one is the current
+// line.
+func (p *exParser) parseRange(ex *exArgs) error {
+	cur := lineno
+	add := func(n int) {
+		ex.line1 = ex.line2
+		ex.line2 = n
+		ex.addrs++
+	}
+	afterSep := false
+	for {
+		p.skipSpace()
+		ok := false
+		if p.peek() == '%' {
+			p.pos++
+			add(0)
+			add(lineCount() - 1)
+			ok = true
+		} else {
+			n, found, err := p.address(cur)
+			if err != nil {
+				return err
+			}
+			if found || afterSep {
+				add(n)
+				ok = true
+			}
+		}
+		p.skipSpace()
+		sep := p.peek()
+		if sep != ',' && sep != ';' {
+			break
+		}
+		if !ok {
+			add(cur)
+		}
+		p.pos++
+		if sep == ';' {
+			cur = ex.line2
+		}
+		afterSep = true
+	}
+	if ex.addrs == 1 {
+		ex.line1 = ex.line2
+	}
+	return nil
+}
+
+// address reads one address with any +N and -N offsets following it,
+// returning false if there is none. Addresses are relative to line cur.
+func (p *exParser) address(cur int) (int, bool, error) {
+	n, found := cur, false
+	switch c := p.peek(); {
+	case c == '.':
+		p.pos++
+		found = true
+	case c == '$':
+		p.pos++
+		n = lineCount() - 1
+		found = true
+	case isDigit(c):
+		n = p.number() - 1
+		found = true
+	case c == '\'':
+		if p.pos+1 >= len(p.text) {
+			return 0, false, errors.New("missing mark name")
+		}
+		m := p.text[p.pos+1]
+		p.pos += 2
+		var err error
+		if n, err = markLine(m); err != nil {
+			return 0, false, err
+		}
+		found = true
+	case c == '/' || c == '?':
+		p.pos++
+		pat, rest, _ := splitSearch(p.text[p.pos:], c)
+		p.pos = len(p.text) - len(rest)
+		var err error
+		if n, err = patternAddress(pat, cur, c == '/'); err != nil {
+			return 0, false, err
+		}
+		found = true
+	case c == '\\':
+		if p.pos+1 >= len(p.text) || strings.IndexByte("/?&", p.text[p.pos+1]) < 0 {
+			return 0, false, errors.New("\\ should be followed by /, ? or &")
+		}
+		forward := p.text[p.pos+1] != '?'
+		p.pos += 2
+		var err error
+		if n, err = patternAddress("", cur, forward); err != nil {
+			return 0, false, err
+		}
+		found = true
+	}
+
+	for {
+		c := p.peek()
+		if c != '+' && c != '-' {
+			break
+		}
+		p.pos++
+		k := 1
+		if isDigit(p.peek()) {
+			k = p.number()
+		}
+		if c == '-' {
+			k = -k
+		}
+		n += k
+		found = true
+	}
+	return n, found, nil
+}
+
+// patternAddress finds the next line after cur matching pat, or the one
+// before it going backwards, the empty pattern meaning the last one
+func patternAddress(pat string, cur int, forward bool) (int, error) {
+	if pat != "" {
+		searchTerm = pat
+	}
+	if searchTerm == "" {
+		return 0, errors.New("no previous search pattern")
+	}
+	re, err := compilePattern(searchTerm)
+	if err != nil {
+		return 0, err
+	}
+	x := 0
+	if forward {
+		x = len(nthLine(cur).text)
+	}
+	n, _, _, _, ok := findWrapped(re, cur, x, forward)
+	if !ok {
+		return 0, fmt.Errorf("pattern not found: %s", searchTerm)
+	}
+	return n, nil
+}
+
+// showOutput puts what commands listed on the screen a page at a time,
+// or on the message line if it is a single line
+func showOutput(lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	if len(lines) == 1 {
+		clearBanner()
+		flash(lines[0])
+		return
+	}
+	rows := max(height-1, 1)
+	for start := 0; start < len(lines); start += rows {
+		clear()
+		end := min(start+rows, len(lines))
+		for i, text := range lines[start:end] {
+			move(1, i+1)
+			if len(text) > width {
+				text = text[:width]
+			}
+			paint(text)
+		}
+		if end < len(lines) {
+			move(1, height)
+			paint("-- More --")
+			if c := getchar(); c == 'q' || c == ESCAPE_CODE {
+				break
+			}
+		} else {
+			pressEnter()
+		}
+	}
+	redraw()
+	restore()
+}
+
+const hitEnterPrompt = "Press ENTER or type command to continue"
+
+// pressEnter waits for a key after output has been left on the screen
+func pressEnter() {
+	move(1, height)
+	clearLineRight()
+	paint(hitEnterPrompt)
+	getchar()
+}
+
+func exPrint(ex *exArgs) error {
+	numbered := ex.cmd.name != "print"
+	l := nthLine(ex.line1)
+	for n := ex.line1; n <= ex.line2 && l != nil; n++ {
+		if numbered {
+			report(fmt.Sprintf("%3d %s", n+1, l.text))
+		} else {
+			report(l.text)
+		}
+		l = l.next
+	}
+	jumpTo(ex.line2)
+	firstNonBlank()
+	return nil
+}
+
+func exLineNumber(ex *exArgs) error {
+	n := lineCount()
+	if ex.addrs > 0 {
+		n = ex.line2 + 1
+	}
+	report(strconv.Itoa(n))
+	return nil
+}
+
+func exMark(ex *exArgs) error {
+	if len(ex.arg) != 1 || !validMark(ex.arg[0]) {
+		return fmt.Errorf("invalid mark: %s", ex.arg)
+	}
+	setMark(ex.arg[0], nthLine(ex.line2), 0)
+	return nil
+}
+
+func exMarks(ex *exArgs) error {
+	for _, text := range markList() {
+		report(text)
+	}
+	return nil
+}
+
+func exRegisters(ex *exArgs) error {
+	for _, text := range registerList(ex.arg) {
+		report(text)
+	}
+	return nil
+}
+
+func exNohlsearch(ex *exArgs) error {
+	noHlsearch = true
+	redraw()
+	return nil
+}
+
+func exSet(ex *exArgs) error {
+	setOptions(splitOptionArgs(ex.arg))
+	return nil
+}
+
+// errModified is given for commands that would lose changes
+var errModified = errors.New("No write since last change (add ! to override)")
+
+func exQuit(ex *exArgs) error {
+	if !ex.bang {
+		return quitWindow()
+	}
+	if windowCount() == 1 && len(tabs) == 1 {
+		quit = true
+		return nil
+	}
+	if isModified() && !bufferShown(curBuf, curWin) {
+		curBuf.loaded = false // throw the changes away
+	}
+	return closeWindow(curWin)
+}
+
+// exNormal runs its argument as normal mode commands, once on each line of
+// the range or just once where the cursor is. Like :global it keeps hold
+// of the lines themselves, so the commands may delete lines.
+func exNormal(ex *exArgs) error {
+	if ex.arg == "" {
+		return errors.New("argument required")
+	}
+	lines := []*line{currentLine}
+	if ex.addrs > 0 {
+		lines = nil
+		l := nthLine(ex.line1)
+		for n := ex.line1; n <= ex.line2 && l != nil; n++ {
+			lines = append(lines, l)
+			l = l.next
+		}
+	}
+
+	saveUndo()
+	undoGroup++
+	savedQueue := keyQueue
+	queueDepth++
+	defer func() {
+		queueDepth--
+		keyQueue = savedQueue
+		undoGroup--
+	}()
+	for _, l := range lines {
+		if quit {
+			break
+		}
+		if ex.addrs > 0 {
+			n := lineIndex(l)
+			if n < 0 {
+				continue
+			}
+			textX = 0
+			jumpTo(n)
+		}
+		keyQueue = []byte(ex.arg)
+		for len(keyQueue) > 0 && !quit {
+			normalCommand()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"time"
+)
+
+// fileStamp identifies a version of a file on disk
+type fileStamp struct {
+	exists bool
+	mtime  time.Time
+	size   int64
+	hash   [sha256.Size]byte
+}
+
+func (s fileStamp) same(other fileStamp) bool {
+	return s.exists == other.exists && s.hash == other.hash
+}
+
+// diskStamp is the version of the file last read or written, and
+// warnedStamp the changed version last warned about, if warned is set
+var diskStamp fileStamp
+var warnedStamp fileStamp
+var warned bool
+
+// statFile stamps a file from its metadata, leaving out the hash
+func statFile(name string) fileStamp {
+	info, err := os.Stat(name)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{exists: true, mtime: info.ModTime(), size: info.Size()}
+}
+
+func stampFile(name string) fileStamp {
+	s := statFile(name)
+	if data, err := os.ReadFile(name); err == nil && s.exists {
+		s.hash = sha256.Sum256(data)
+	}
+	return s
+}
+
+// recordStamp notes the file as it is now, after reading or writing it
+func recordStamp(name string) {
+	diskStamp = stampFile(name)
+	warned = false
+}
+
+// diskChanged reports whether another program has changed the file since
+// it was last read or written. The contents are only hashed when the size
+// or time differs, and a file that was merely touched does not count.
+func diskChanged() (fileStamp, bool) {
+	now := statFile(filename)
+	if now.exists == diskStamp.exists && now.size == diskStamp.size && now.mtime.Equal(diskStamp.mtime) {
+		return diskStamp, false
+	}
+	now = stampFile(filename)
+	if now.same(diskStamp) {
+		diskStamp = now
+		return now, false
+	}
+	return now, true
+}
+
+// idle is set while normal mode waits for a command, the only time the
+// buffer can safely be reloaded from under the user
+var idle bool
+
+// checkFile looks for changes made to the file by other programs. With
+// 'autoread' set and nothing here to lose it reloads the file, and
+// otherwise it warns once about each change.
+func checkFile() {
+	if filename == "" {
+		return
+	}
+	now, changed := diskChanged()
+	if !changed || warned && now.same(warnedStamp) {
+		return
+	}
+	warned = true
+	warnedStamp = now
+	switch {
+	case !now.exists:
+		flash(fmt.Sprintf("\"%s\" is no longer available", filename))
+	case optBool("autoread") && !isModified():
+		if err := reloadFile(); err != nil {
+			flash(err.Error())
+		}
+	default:
+		flash(fmt.Sprintf("\"%s\" has changed since editing started, :e! to reload", filename))
+	}
+}
+
+// reloadFile reads the file again, keeping the cursor on the same line
+func reloadFile() error {
+	n, x := lineno, textX
+	visible := firstVisible()
+	msg, err := loadFile(filename)
+	if err != nil {
+		return err
+	}
+	setFirstVisible(visible)
+	textX = x
+	setCursor(n)
+	redraw()
+	refresh(nil)
+	flash(msg + " reloaded")
+	return nil
+}
+
+// confirmOverwrite asks before writing over a file that has changed
+// since it was read
+func confirmOverwrite() bool {
+	if _, changed := diskChanged(); !changed {
+		return true
+	}
+	clearBanner()
+	flash("WARNING: the file has changed since reading it! Write anyway (y/n)?")
+	c := getchar()
+	clearBanner()
+	return c == 'y' || c == 'Y'
+}
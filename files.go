@@ -0,0 +1,363 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// fileFormat is "dos" when the file's lines end in CR LF and "unix" when
+// they end in LF, and fileEncoding is what its text appears to be in.
+// readOnly is set when the file cannot be written.
+var fileFormat = "unix"
+var fileEncoding = "utf-8"
+var readOnly bool
+
+// readLines reads a file as lines, without their line endings, reporting
+// whether every line ended in CR LF
+func readLines(name string) ([]string, int, bool, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	text := strings.TrimSuffix(string(data), "\n")
+	if text == "" && len(data) <= 1 {
+		return nil, len(data), false, nil
+	}
+	lines := strings.Split(text, "\n")
+	dos := true
+	for i, l := range lines {
+		dos = dos && strings.HasSuffix(l, "\r")
+		lines[i] = strings.TrimSuffix(l, "\r")
+	}
+	return lines, len(data), dos, nil
+}
+
+// setBuffer replaces the whole buffer with lines, starting afresh with
+// the cursor at the top and nothing to undo
+func setBuffer(lines []string) {
+	top = lineNew()
+	topOfScreen = top
+	numLines = 0
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+	insertLinesAfter(top, lines)
+	setTop(top, -1)
+	currentLine = top.next
+	lineno = 0
+	textX = 0
+	undoStack = nil
+	redoStack = nil
+	marks = map[byte]mark{}
+	fileFormat = "unix"
+	fileEncoding = "utf-8"
+	readOnly = false
+}
+
+// loadFile makes the buffer hold the named file, or an empty buffer if
+// it does not exist yet, returning a description for the message line
+func loadFile(name string) (string, error) {
+	lines, size, dos, err := readLines(name)
+	if errors.Is(err, os.ErrNotExist) {
+		setBuffer(nil)
+		markSaved()
+		recordStamp(name)
+		return fmt.Sprintf("\"%s\" [New]", name), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot read \"%s\": %v", name, err)
+	}
+	setBuffer(lines)
+	markSaved()
+	recordStamp(name)
+	if dos {
+		fileFormat = "dos"
+	}
+	for _, l := range lines {
+		if !utf8.ValidString(l) {
+			fileEncoding = "latin1"
+			break
+		}
+	}
+	readOnly = !writable(name)
+	return fmt.Sprintf("\"%s\" %dL, %dB", name, len(lines), size), nil
+}
+
+// writeLines writes lines first to last to the named file, adding them
+// to the end of it when appending
+func writeLines(name string, first int, last int, appending bool) error {
+	mode := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appending {
+		mode = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	file, err := os.OpenFile(name, mode, 0666)
+	if err != nil {
+		return fmt.Errorf("cannot write \"%s\": %v", name, err)
+	}
+	texts := lineTexts(first, last)
+	eol := "\n"
+	if fileFormat == "dos" {
+		eol = "\r\n"
+	}
+	data := strings.Join(texts, eol) + eol
+	if _, err := file.WriteString(data); err != nil {
+		file.Close()
+		return fmt.Errorf("cannot write \"%s\": %v", name, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("cannot write \"%s\": %v", name, err)
+	}
+	verb := "written"
+	if appending {
+		verb = "appended"
+	}
+	flash(fmt.Sprintf("\"%s\" %dL, %dB %s", name, len(texts), len(data), verb))
+	return nil
+}
+
+// expandFileName puts the current file name in place of %, the alternate
+// file name in place of # and the home directory in place of a leading ~,
+// and drops the backslashes escaping spaces
+func expandFileName(arg string) (string, error) {
+	var b strings.Builder
+	if strings.HasPrefix(arg, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			b.WriteString(home)
+			arg = arg[1:]
+		}
+	}
+	for i := 0; i < len(arg); i++ {
+		c := arg[i]
+		switch {
+		case c == '\\' && i+1 < len(arg) && strings.IndexByte(" %#", arg[i+1]) >= 0:
+			i++
+			b.WriteByte(arg[i])
+		case c == '%':
+			if filename == "" {
+				return "", errors.New("no file name to substitute for '%'")
+			}
+			b.WriteString(filename)
+		case c == '#':
+			if altBuf == nil || altBuf.filename == "" {
+				return "", errors.New("no alternate file name to substitute for '#'")
+			}
+			b.WriteString(altBuf.filename)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+// sameFile reports whether a and b name the same file
+func sameFile(a string, b string) bool {
+	if a == b {
+		return true
+	}
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	if errA == nil && errB == nil {
+		return os.SameFile(infoA, infoB)
+	}
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// writable reports whether the named file can be opened for writing
+func writable(name string) bool {
+	file, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return false
+	}
+	file.Close()
+	return true
+}
+
+// askFileName prompts for a name for an unnamed buffer
+func askFileName() (string, bool) {
+	name, ok := readLine("File name: ", &fileHistory, "", nil)
+	clearBanner()
+	if !ok || strings.TrimSpace(name) == "" {
+		return "", false
+	}
+	name, err := expandFileName(strings.TrimSpace(name))
+	if err != nil {
+		flash(err.Error())
+		return "", false
+	}
+	return name, true
+}
+
+// exWrite is :w, :wq and :x, each of which can write a range, write to
+// another file, or add to the end of one with >>. :w !cmd is handled by
+// writeShell.
+func exWrite(ex *exArgs) error {
+	if ex.cmd.name == "write" && strings.HasPrefix(ex.arg, "!") {
+		return writeShell(ex.line1, ex.line2, ex.arg[1:])
+	}
+	ex.splitBar()
+	arg := ex.arg
+	appending := strings.HasPrefix(arg, ">>")
+	if appending {
+		arg = strings.TrimSpace(arg[2:])
+	}
+	name, err := expandFileName(arg)
+	if err != nil {
+		return err
+	}
+	xit := ex.cmd.name == "xit" || ex.cmd.name == "exit"
+	if xit && name == "" && !isModified() && (filename == "" || fileExists(filename)) {
+		return quitWindow() // :x only writes when there are changes
+	}
+	if name == "" {
+		name = filename
+	}
+	if name == "" {
+		var ok bool
+		if name, ok = askFileName(); !ok {
+			return nil
+		}
+	}
+
+	partial := ex.line1 > 0 || ex.line2 < lineCount()-1
+	current := filename != "" && sameFile(name, filename)
+	if current && readOnly && !ex.bang {
+		return errors.New("'readonly' option is set (add ! to override)")
+	}
+	if current && partial && !appending && !ex.bang {
+		return errors.New("use ! to write partial buffer")
+	}
+	if !current && !appending && !ex.bang && fileExists(name) {
+		return fmt.Errorf("\"%s\" exists (add ! to override)", name)
+	}
+	if current && !ex.bang && !confirmOverwrite() {
+		return errors.New("not written")
+	}
+	if filename == "" {
+		filename = name
+		current = true
+	}
+	if err := writeLines(name, ex.line1, ex.line2, appending); err != nil {
+		return err
+	}
+	if current {
+		recordStamp(name)
+		if !partial && !appending {
+			markSaved()
+		}
+	}
+	if ex.cmd.name != "write" {
+		return quitWindow()
+	}
+	return nil
+}
+
+// exSaveas writes the buffer to a new name, which it takes on
+func exSaveas(ex *exArgs) error {
+	name, err := expandFileName(ex.arg)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		var ok bool
+		if name, ok = askFileName(); !ok {
+			return nil
+		}
+	}
+	if !ex.bang && fileExists(name) && !(filename != "" && sameFile(name, filename)) {
+		return fmt.Errorf("\"%s\" exists (add ! to override)", name)
+	}
+	if err := writeLines(name, 0, lineCount()-1, false); err != nil {
+		return err
+	}
+	filename = name
+	markSaved()
+	recordStamp(name)
+	return nil
+}
+
+// exEdit shows the buffer for another file, opening one if needed, or
+// reads the current one again when no name is given. Either refuses to
+// leave changes behind unless forced with !, which throws them away.
+func exEdit(ex *exArgs) error {
+	name, err := expandFileName(ex.arg)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		name = filename
+	}
+	if name == "" {
+		return errors.New("no file name")
+	}
+	if filename != "" && sameFile(name, filename) {
+		if isModified() && !ex.bang {
+			return errModified
+		}
+		return reloadFile()
+	}
+	left, discard := curBuf, isModified()
+	if err := editFile(name, ex.bang); err != nil {
+		return err
+	}
+	if discard && curBuf != left && !bufferShown(left, nil) {
+		left.loaded = false // read the file again when going back to it
+	}
+	return nil
+}
+
+// exRead is :r {file}, putting the file below the last line of the
+// range, and :r !cmd or :r!cmd, putting the output of cmd there
+func exRead(ex *exArgs) error {
+	if ex.bang {
+		return readShell(ex.line2, ex.arg)
+	}
+	if strings.HasPrefix(ex.arg, "!") {
+		return readShell(ex.line2, ex.arg[1:])
+	}
+	ex.splitBar()
+	name, err := expandFileName(ex.arg)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		name = filename
+	}
+	if name == "" {
+		return errors.New("no file name")
+	}
+	lines, size, _, err := readLines(name)
+	if err != nil {
+		return fmt.Errorf("cannot read \"%s\": %v", name, err)
+	}
+	if len(lines) > 0 {
+		saveUndo()
+		insertLinesAfter(nthLine(ex.line2), lines)
+		finishLines(ex.line2 + 1)
+	}
+	flash(fmt.Sprintf("\"%s\" %dL, %dB", name, len(lines), size))
+	return nil
+}
+
+// ZHandle is ZZ, which writes the file if needed and quits, and ZQ, which
+// quits without writing
+func ZHandle() {
+	switch c := getchar(); c {
+	case 'Z':
+		execute("x")
+	case 'Q':
+		execute("q!")
+	default:
+		flash(fmt.Sprintf("unknown command: 'Z%c'", c))
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// globalBusy is set while :global runs its command, which cannot be
+// another :global
+var globalBusy bool
+
+// subTotals adds up the substitutions made under :global, to be reported
+// once at the end
+var subTotals struct {
+	subs  int
+	lines int
+}
+
+// exGlobal runs a command on every line matching a pattern, or with :v
+// and :g! on every line that does not. The lines are picked out first and
+// kept as pointers, so the command can delete or move lines without the
+// rest being lost track of.
+func exGlobal(ex *exArgs) error {
+	if globalBusy {
+		return errors.New("cannot do :global recursively")
+	}
+	invert := ex.bang || ex.cmd.name == "vglobal"
+	if ex.arg == "" || !isSubDelimiter(ex.arg[0]) {
+		return errors.New("regular expression missing from :global")
+	}
+	pattern, cmd, _ := splitSearch(ex.arg[1:], ex.arg[0])
+	if pattern == "" {
+		pattern = searchTerm
+	}
+	if pattern == "" {
+		return errors.New("no previous regular expression")
+	}
+	re, err := compilePattern(pattern)
+	if err != nil {
+		return err
+	}
+	searchTerm = pattern
+	if cmd == "" {
+		cmd = "p"
+	}
+
+	var matched []*line
+	l := nthLine(ex.line1)
+	for n := ex.line1; n <= ex.line2 && l != nil; n++ {
+		if re.MatchString(l.text) != invert {
+			matched = append(matched, l)
+		}
+		l = l.next
+	}
+	if len(matched) == 0 {
+		if invert {
+			return fmt.Errorf("pattern found in every line: %s", pattern)
+		}
+		return fmt.Errorf("pattern not found: %s", pattern)
+	}
+
+	saveUndo()
+	undoGroup++
+	globalBusy = true
+	subTotals.subs, subTotals.lines = 0, 0
+	defer func() {
+		undoGroup--
+		globalBusy = false
+	}()
+	setCursor(ex.line1)
+	for _, l := range matched {
+		n := globalLine(l)
+		if n < 0 {
+			continue // deleted by the command run on an earlier line
+		}
+		lineno, currentLine = n, l
+		clampTextX()
+		if err := runCommands(cmd); err != nil {
+			redraw()
+			refresh(nil)
+			return err
+		}
+	}
+	redraw()
+	refresh(nil)
+	if subTotals.subs > 1 {
+		report(plural(subTotals.subs, "substitution") + " on " + plural(subTotals.lines, "line"))
+	}
+	return nil
+}
+
+// globalLine is the index of l, a line :g matched. It is looked for from the
+// cursor down, as the command run on the line before leaves the cursor above
+// it unless it moved or deleted lines.
+func globalLine(l *line) int {
+	n := lineno
+	for c := currentLine; c != nil; c = c.next {
+		if c == l {
+			return n
+		}
+		n++
+	}
+	return lineIndex(l)
+}
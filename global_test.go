@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGlobal(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"g/a/d", "b1 b2"},
+		{"v/a/d", "a1 a2 a3"},
+		{"g/a/m0", "a3 a2 a1 b1 b2"},
+		{"g/a/t.", "a1 a1 b1 a2 a2 b2 a3 a3"},
+		{"g/a/.,+1d", "a3"},
+		{"g/a/s/a/c/", "c1 b1 c2 b2 c3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			startEditor([]string{"a1", "b1", "a2", "b2", "a3"})
+			typeKeys(":" + tt.command + "\r")
+			if got := strings.Join(lineTexts(0, lineCount()-1), " "); got != tt.want {
+				t.Errorf("buffer is %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// gutterWidth is the width of the column of line numbers at the left of
+// the current window, including the space after them, or 0 when neither
+// 'number' nor 'relativenumber' is set. It grows with the numbers shown.
+func gutterWidth() int {
+	number, relative := optBool("number"), optBool("relativenumber")
+	if !number && !relative {
+		return 0
+	}
+	biggest := textRows()
+	if number {
+		biggest = lineCount()
+	}
+	w := max(len(strconv.Itoa(biggest))+1, optNumber("numberwidth"))
+	if w >= winCols {
+		return 0 // no room left for the text
+	}
+	return w
+}
+
+// textCol is the screen column where the current window's text starts
+func textCol() int {
+	return winCol + gutterWidth()
+}
+
+// textCols is how many columns of text the current window shows
+func textCols() int {
+	return winCols - gutterWidth()
+}
+
+// lineLabel is what the gutter shows for line n. With 'relativenumber'
+// lines are numbered by their distance from the cursor line, which with
+// 'number' as well shows its own number, left aligned.
+func lineLabel(n int, w int) string {
+	if !optBool("relativenumber") {
+		return fmt.Sprintf("%*d ", w-1, n+1)
+	}
+	if n == lineno && optBool("number") {
+		return fmt.Sprintf("%-*d ", w-1, n+1)
+	}
+	return fmt.Sprintf("%*d ", w-1, abs(n-lineno))
+}
+
+// drawGutter draws the number of line n on row y of the current window,
+// or leaves it blank for n < 0 on the later rows of a wrapped line
+func drawGutter(y int, n int) {
+	w := gutterWidth()
+	if w == 0 {
+		return
+	}
+	move(winCol, winRow+y-1)
+	if n < 0 {
+		paint(strings.Repeat(" ", w))
+		return
+	}
+	paint(attrLineNr + lineLabel(n, w) + attrReset)
+}
+
+// drawRelativeNumbers redraws the gutter of every line in the current
+// window with 'relativenumber' set, as the numbers change whenever the
+// cursor moves
+func drawRelativeNumbers() {
+	if !optBool("relativenumber") || gutterWidth() == 0 {
+		return
+	}
+	y, n := 1, firstVisible()
+	for l := topOfScreen.next; l != nil && y <= textRows(); l = l.next {
+		rows := lineRows(l.text)
+		if y > 1 && y+rows-1 > textRows() {
+			break
+		}
+		drawGutter(y, n)
+		y += rows
+		n++
+	}
+	restore()
+}
+
+// drawFiller marks row y of the current window as past the end of the
+// buffer
+func drawFiller(y int) {
+	move(winCol, winRow+y-1)
+	paint("~" + strings.Repeat(" ", max(winCols-1, 0)))
+}
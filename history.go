@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type history struct {
+	kind    byte
+	entries []string
+}
+
+var commandHistory = history{kind: ':'}
+var searchHistory = history{kind: '/'}
+
+// fileHistory holds the names typed when asked for one, which are not
+// kept between sessions
+var fileHistory = history{kind: 'f'}
+
+// add appends entry, dropping an older copy of it and the oldest entries
+// beyond the 'history' option
+func (h *history) add(entry string) {
+	if entry == "" {
+		return
+	}
+	kept := h.entries[:0]
+	for _, e := range h.entries {
+		if e != entry {
+			kept = append(kept, e)
+		}
+	}
+	h.entries = append(kept, entry)
+	if limit := optNumber("history"); limit > 0 && len(h.entries) > limit {
+		h.entries = h.entries[len(h.entries)-limit:]
+	}
+}
+
+// older finds the newest entry before index i starting with prefix,
+// returning its index or -1
+func (h *history) older(i int, prefix string) int {
+	for i--; i >= 0; i-- {
+		if strings.HasPrefix(h.entries[i], prefix) {
+			return i
+		}
+	}
+	return -1
+}
+
+// newer finds the oldest entry after index i starting with prefix,
+// returning its index or len(h.entries)
+func (h *history) newer(i int, prefix string) int {
+	for i++; i < len(h.entries); i++ {
+		if strings.HasPrefix(h.entries[i], prefix) {
+			return i
+		}
+	}
+	return len(h.entries)
+}
+
+func historyFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".viz_history")
+}
+
+// loadHistory reads the command and search histories kept by earlier
+// sessions
+func loadHistory() {
+	path := historyFile()
+	if path == "" {
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		text := scanner.Text()
+		if text == "" {
+			continue
+		}
+		switch text[0] {
+		case ':':
+			commandHistory.add(text[1:])
+		case '/':
+			searchHistory.add(text[1:])
+		}
+	}
+}
+
+func saveHistory() {
+	path := historyFile()
+	if path == "" {
+		return
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	for _, h := range []*history{&commandHistory, &searchHistory} {
+		for _, entry := range h.entries {
+			if strings.ContainsAny(entry, "\r\n") {
+				continue
+			}
+			w.WriteString(string(h.kind) + entry + "\n") //nolint
+		}
+	}
+	w.Flush() //nolint
+}
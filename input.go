@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"time"
+)
+
+// keys outside the byte range, decoded from escape sequences
+const (
+	KEY_UP = 256 + iota
+	KEY_DOWN
+	KEY_RIGHT
+	KEY_LEFT
+	KEY_HOME
+	KEY_END
+	KEY_DELETE
+	KEY_UNKNOWN
+)
+
+// escapeTimeout is how long to wait after an escape for the rest of a
+// cursor key sequence before taking it as a plain escape
+const escapeTimeout = 25 * time.Millisecond
+
+var inputWanted = make(chan bool)
+var input = make(chan []byte)
+
+// inputRequested is set while readInput has been asked for input that
+// has not arrived yet
+var inputRequested bool
+
+// keyQueue holds keys to be run as though typed, for :normal. While
+// queueDepth is above zero getchar reads only from it, giving escape once
+// it runs out so that an unfinished command is abandoned.
+var keyQueue []byte
+var queueDepth int
+
+// pending holds input that has been read but not consumed by getchar
+var pending []byte
+
+// readInput reads the terminal on behalf of getchar. It only reads when
+// asked to, so that nothing is taken from programs started by the editor.
+func readInput() {
+	buf := make([]byte, 256)
+	for range inputWanted {
+		n, err := os.Stdin.Read(buf)
+		if err != nil || n == 0 {
+			input <- []byte{0}
+			continue
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		input <- data
+	}
+}
+
+// waitInput returns the next chunk of input, or nil if none arrives
+// within timeout. A zero timeout waits for as long as it takes.
+func waitInput(timeout time.Duration) []byte {
+	flush()
+	if !inputRequested {
+		inputWanted <- true
+		inputRequested = true
+	}
+	if timeout == 0 {
+		for {
+			select {
+			case data := <-input:
+				inputRequested = false
+				return data
+			case <-fileCheckTicker.C:
+				if idle {
+					checkFile()
+					flush()
+				}
+			}
+		}
+	}
+	select {
+	case data := <-input:
+		inputRequested = false
+		return data
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// fileCheckTicker paces the checks for the file being changed by other
+// programs while waiting for a key
+var fileCheckTicker = time.NewTicker(2 * time.Second)
+
+// the terminal reports gaining and losing focus as these sequences
+// between the two
+const (
+	focusReportingOn  = "\x1b[?1004h"
+	focusReportingOff = "\x1b[?1004l"
+	focusIn           = "\x1b[I"
+	focusOut          = "\x1b[O"
+)
+
+// takeFocusEvents removes focus reports from input, checking the file
+// when focus comes back while normal mode is waiting for a command
+func takeFocusEvents(data []byte) []byte {
+	gained := false
+	for _, seq := range []string{focusIn, focusOut} {
+		for {
+			i := bytes.Index(data, []byte(seq))
+			if i < 0 {
+				break
+			}
+			gained = gained || seq == focusIn
+			data = append(data[:i:i], data[i+len(seq):]...)
+		}
+	}
+	if gained && idle {
+		checkFile()
+	}
+	return data
+}
+
+var escapeSequences = map[string]int{
+	"[A": KEY_UP, "OA": KEY_UP,
+	"[B": KEY_DOWN, "OB": KEY_DOWN,
+	"[C": KEY_RIGHT, "OC": KEY_RIGHT,
+	"[D": KEY_LEFT, "OD": KEY_LEFT,
+	"[H": KEY_HOME, "OH": KEY_HOME, "[1~": KEY_HOME, "[7~": KEY_HOME,
+	"[F": KEY_END, "OF": KEY_END, "[4~": KEY_END, "[8~": KEY_END,
+	"[3~": KEY_DELETE,
+}
+
+// readKey reads a key like getchar, but decodes the sequences sent by the
+// cursor and editing keys
+func readKey() int {
+	c := getchar()
+	if c != ESCAPE_CODE || queueDepth > 0 {
+		return int(c)
+	}
+	// end finds the final byte of a sequence in pending, if it is all there
+	end := func() int {
+		if len(pending) < 2 {
+			return -1
+		}
+		i := 1
+		for i < len(pending) && (pending[i] >= '0' && pending[i] <= '9' || pending[i] == ';') {
+			i++
+		}
+		if i >= len(pending) {
+			return -1
+		}
+		return i
+	}
+	i := end()
+	for i < 0 {
+		if len(pending) > 0 && pending[0] != '[' && pending[0] != 'O' {
+			return ESCAPE_CODE
+		}
+		more := waitInput(escapeTimeout)
+		if more == nil {
+			return ESCAPE_CODE
+		}
+		pending = append(pending, more...)
+		i = end()
+	}
+	if pending[0] != '[' && pending[0] != 'O' {
+		return ESCAPE_CODE
+	}
+	seq := string(pending[:i+1])
+	pending = pending[i+1:]
+	if key, ok := escapeSequences[seq]; ok {
+		return key
+	}
+	return KEY_UNKNOWN
+}
+
+// normalKey reads a key for normal and visual mode, where the cursor keys
+// stand for h, j, k and l
+func normalKey() byte {
+	switch key := readKey(); key {
+	case KEY_UP:
+		return 'k'
+	case KEY_DOWN:
+		return 'j'
+	case KEY_RIGHT:
+		return 'l'
+	case KEY_LEFT:
+		return 'h'
+	case KEY_HOME:
+		return '0'
+	case KEY_END:
+		return '$'
+	case KEY_DELETE:
+		return 'x'
+	default:
+		if key > 255 {
+			return ESCAPE_CODE
+		}
+		return byte(key)
+	}
+}
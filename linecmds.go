@@ -0,0 +1,405 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// lineTexts copies the text of lines first through last
+func lineTexts(first int, last int) []string {
+	var texts []string
+	l := nthLine(first)
+	for n := first; n <= last && l != nil; n++ {
+		texts = append(texts, l.text)
+		l = l.next
+	}
+	return texts
+}
+
+// applyCount makes a range of count lines starting at the last line of
+// the range given, as a trailing count does for :d, :y, :j and :>
+func applyCount(ex *exArgs, arg string) error {
+	if arg == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		return fmt.Errorf("trailing characters: %s", arg)
+	}
+	if n <= 0 {
+		return errors.New("positive count required")
+	}
+	ex.line1 = ex.line2
+	ex.line2 = min(ex.line2+n-1, lineCount()-1)
+	return nil
+}
+
+// registerAndCount reads the [x] [count] argument of :d and :y
+func registerAndCount(ex *exArgs) (byte, error) {
+	arg := ex.arg
+	var reg byte
+	if arg != "" && !isDigit(arg[0]) {
+		reg = arg[0]
+		if !validRegister(reg) || readOnlyRegister(reg) {
+			return 0, fmt.Errorf("invalid register: '%c'", reg)
+		}
+		arg = strings.TrimSpace(arg[1:])
+	}
+	return reg, applyCount(ex, arg)
+}
+
+// targetAddress reads the single address :m and :t take as argument
+func targetAddress(arg string) (int, error) {
+	p := &exParser{text: arg}
+	target := &exArgs{line1: lineno, line2: lineno}
+	if err := p.parseRange(target); err != nil {
+		return 0, err
+	}
+	p.skipSpace()
+	if target.addrs == 0 || p.pos < len(p.text) {
+		return 0, fmt.Errorf("invalid address: %s", arg)
+	}
+	if target.line2 < -1 || target.line2 > lineCount()-1 {
+		return 0, errors.New("invalid range")
+	}
+	return target.line2, nil
+}
+
+// finishLines redraws after a line command and leaves the cursor on the
+// first non-blank of line n
+func finishLines(n int) {
+	setCursor(n)
+	redraw()
+	refresh(nil)
+	firstNonBlank()
+}
+
+func exDelete(ex *exArgs) error {
+	reg, err := registerAndCount(ex)
+	if err != nil {
+		return err
+	}
+	saveUndo()
+	pendingRegister = reg
+	deleteText(lineTexts(ex.line1, ex.line2), linewise)
+	removeLines(ex.line1, ex.line2)
+	finishLines(ex.line1)
+	if count := ex.line2 - ex.line1 + 1; count > 2 && !globalBusy {
+		report(fmt.Sprintf("%d fewer lines", count))
+	}
+	return nil
+}
+
+func exYank(ex *exArgs) error {
+	reg, err := registerAndCount(ex)
+	if err != nil {
+		return err
+	}
+	pendingRegister = reg
+	yankText(lineTexts(ex.line1, ex.line2), linewise)
+	if count := ex.line2 - ex.line1 + 1; count > 2 && !globalBusy {
+		report(fmt.Sprintf("%d lines yanked", count))
+	}
+	return nil
+}
+
+// exMove moves the range below the target line, relinking the line
+// structs themselves so that marks on them move too
+func exMove(ex *exArgs) error {
+	target, err := targetAddress(ex.arg)
+	if err != nil {
+		return err
+	}
+	if target >= ex.line1 && target < ex.line2 {
+		return errors.New("cannot move a range of lines into itself")
+	}
+	saveUndo()
+	visible := firstVisible()
+	first := nthLine(ex.line1)
+	last := nthLine(ex.line2)
+	after := nthLine(target)
+	if after != last && after != first.prev {
+		changeLines(0, false, false)
+		first.prev.next = last.next
+		if last.next != nil {
+			last.next.prev = first.prev
+		}
+		first.prev = after
+		last.next = after.next
+		if after.next != nil {
+			after.next.prev = last
+		}
+		after.next = first
+	}
+	setFirstVisible(visible)
+	finishLines(lineIndex(last))
+	return nil
+}
+
+func exCopy(ex *exArgs) error {
+	target, err := targetAddress(ex.arg)
+	if err != nil {
+		return err
+	}
+	saveUndo()
+	last := insertLinesAfter(nthLine(target), lineTexts(ex.line1, ex.line2))
+	finishLines(lineIndex(last))
+	return nil
+}
+
+// exJoin joins the lines of the range, which is the current line and the
+// next when fewer than two lines are given. With ! the lines are joined
+// as they are, without adding or removing white space.
+func exJoin(ex *exArgs) error {
+	if err := applyCount(ex, ex.arg); err != nil {
+		return err
+	}
+	if ex.line1 == ex.line2 {
+		ex.line2++
+	}
+	if ex.line2 > lineCount()-1 {
+		ex.line2 = lineCount() - 1
+	}
+	if ex.line1 == ex.line2 {
+		return nil
+	}
+	saveUndo()
+	l := nthLine(ex.line1)
+	count := ex.line2 - ex.line1 + 1
+	if ex.bang {
+		for i := 1; i < count && l.next != nil; i++ {
+			l.text += l.next.text
+			deleteLine(l.next)
+		}
+	} else {
+		joinLines(l, count)
+	}
+	finishLines(ex.line1)
+	return nil
+}
+
+// exShift is :> and :<, where each repeat of the name shifts once more
+func exShift(ex *exArgs) error {
+	name := ex.cmd.name[0]
+	times := 1 + len(ex.arg) - len(strings.TrimLeft(ex.arg, string(name)))
+	arg := strings.TrimSpace(strings.TrimLeft(ex.arg, string(name)))
+	if err := applyCount(ex, arg); err != nil {
+		return err
+	}
+	dir := times
+	if name == '<' {
+		dir = -times
+	}
+	saveUndo()
+	l := nthLine(ex.line1)
+	for n := ex.line1; n <= ex.line2 && l != nil; n++ {
+		shiftLine(l, dir)
+		l = l.next
+	}
+	finishLines(ex.line2)
+	if count := ex.line2 - ex.line1 + 1; count > 2 && !globalBusy {
+		report(fmt.Sprintf("%d lines %ced %s", count, name, plural(times, "time")))
+	}
+	return nil
+}
+
+type sortKey struct {
+	text    string
+	key     string
+	matched bool
+	hasNum  bool
+	num     int64
+}
+
+var numberPattern = regexp.MustCompile(`-?\d+`)
+
+// exSort sorts the range. The options are n to sort on the first number
+// in each line, i to ignore case, u to keep only the first of equal lines
+// and r to sort on what /pattern/ matches rather than what follows it.
+// Lines without a match keep their order ahead of the sorted ones.
+func exSort(ex *exArgs) error {
+	var numeric, ignoreCase, unique, onMatch bool
+	var re *regexp.Regexp
+	arg := ex.arg
+	for i := 0; i < len(arg); i++ {
+		switch c := arg[i]; {
+		case c == ' ' || c == '\t':
+		case c == 'n':
+			numeric = true
+		case c == 'i':
+			ignoreCase = true
+		case c == 'u':
+			unique = true
+		case c == 'r':
+			onMatch = true
+		case isSubDelimiter(c):
+			pattern, rest, _ := splitSearch(arg[i+1:], c)
+			if pattern == "" {
+				pattern = searchTerm
+			}
+			var err error
+			if re, err = compilePattern(pattern); err != nil {
+				return err
+			}
+			i = len(arg) - len(rest) - 1
+		default:
+			return fmt.Errorf("invalid argument: %s", arg[i:])
+		}
+	}
+
+	keys := make([]sortKey, 0, ex.line2-ex.line1+1)
+	for _, text := range lineTexts(ex.line1, ex.line2) {
+		k := sortKey{text: text, key: text, matched: true}
+		if re != nil {
+			m := re.FindStringIndex(text)
+			switch {
+			case m == nil:
+				k.matched = false
+			case onMatch:
+				k.key = text[m[0]:m[1]]
+			default:
+				k.key = text[m[1]:]
+			}
+		}
+		if ignoreCase {
+			k.key = strings.ToLower(k.key)
+		}
+		if numeric {
+			if s := numberPattern.FindString(k.key); s != "" {
+				k.num, _ = strconv.ParseInt(s, 10, 64)
+				k.hasNum = true
+			}
+		}
+		keys = append(keys, k)
+	}
+
+	compare := func(a sortKey, b sortKey) int {
+		switch {
+		case a.matched != b.matched:
+			if a.matched {
+				return 1
+			}
+			return -1
+		case !a.matched:
+			return 0
+		case numeric && a.hasNum != b.hasNum:
+			if a.hasNum {
+				return 1
+			}
+			return -1
+		case numeric && a.num != b.num:
+			if a.num < b.num {
+				return -1
+			}
+			return 1
+		case numeric:
+			return 0
+		}
+		return strings.Compare(a.key, b.key)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		if ex.bang {
+			return compare(keys[j], keys[i]) < 0
+		}
+		return compare(keys[i], keys[j]) < 0
+	})
+
+	texts := make([]string, 0, len(keys))
+	for i, k := range keys {
+		if unique && i > 0 && k.matched && compare(keys[i-1], k) == 0 {
+			continue
+		}
+		texts = append(texts, k.text)
+	}
+
+	saveUndo()
+	l := nthLine(ex.line1)
+	for _, text := range texts {
+		l.text = text
+		l = l.next
+	}
+	if removed := len(keys) - len(texts); removed > 0 {
+		removeLines(ex.line1+len(texts), ex.line2)
+	}
+	finishLines(ex.line1)
+	return nil
+}
+
+// exRetab redoes the white space containing tabs in the range, reading it
+// with the current 'tabstop' and writing it with the new one given, if
+// any, in tabs or in spaces following 'expandtab'. With ! runs of spaces
+// are changed as well.
+func exRetab(ex *exArgs) error {
+	oldTs := tabStop()
+	newTs := oldTs
+	if arg := strings.TrimSpace(ex.arg); arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid argument: %s", arg)
+		}
+		newTs = n
+	}
+
+	saveUndo()
+	l := nthLine(ex.line1)
+	for n := ex.line1; n <= ex.line2 && l != nil; n++ {
+		l.text = retabLine(l.text, oldTs, newTs, ex.bang)
+		l = l.next
+	}
+	lookupOption("tabstop").numVal = newTs
+	redraw()
+	refresh(nil)
+	return nil
+}
+
+func retabLine(text string, oldTs int, newTs int, force bool) string {
+	var b strings.Builder
+	col := 0
+	for i := 0; i < len(text); {
+		if text[i] != ' ' && text[i] != '\t' {
+			_, size := utf8.DecodeRuneInString(text[i:])
+			b.WriteString(text[i : i+size])
+			i += size
+			col++
+			continue
+		}
+		start, startCol := i, col
+		tabs, spaces := false, 0
+		for ; i < len(text) && (text[i] == ' ' || text[i] == '\t'); i++ {
+			if text[i] == '\t' {
+				tabs = true
+				col += oldTs - col%oldTs
+			} else {
+				spaces++
+				col++
+			}
+		}
+		if tabs || force && spaces > 1 {
+			b.WriteString(fillColumns(startCol, col, newTs))
+		} else {
+			b.WriteString(text[start:i])
+		}
+	}
+	return b.String()
+}
+
+// fillColumns is white space from column start to column end, using tabs
+// of width ts unless 'expandtab' is set
+func fillColumns(start int, end int, ts int) string {
+	if optBool("expandtab") {
+		return strings.Repeat(" ", end-start)
+	}
+	var b strings.Builder
+	col := start
+	for next := (col/ts + 1) * ts; next <= end; next += ts {
+		b.WriteByte('\t')
+		col = next
+	}
+	b.WriteString(strings.Repeat(" ", end-col))
+	return b.String()
+}
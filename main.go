@@ -1,13 +1,10 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"os"
-	"strconv"
 	"strings"
 
-	"github.com/ahmetalpbalkan/go-cursor"
 	"golang.org/x/term"
 )
 
@@ -22,15 +19,47 @@ var filename string
 var top *line
 var topOfScreen *line
 var currentLine *line
-var clipboard string
 var searchTerm string
 
 const (
+	CTRL_B_CODE    = 2
+	CTRL_D_CODE    = 4
+	CTRL_E_CODE    = 5
+	CTRL_F_CODE    = 6
+	CTRL_L_CODE    = 12
 	ENTER_CODE     = 13
+	CTRL_R_CODE    = 18
+	CTRL_U_CODE    = 21
+	CTRL_V_CODE    = 22
+	CTRL_Y_CODE    = 25
 	ESCAPE_CODE    = 27
+	CTRL_CARET     = 30
 	BACKSPACE_CODE = 127
 )
 
+const (
+	attrReset     = "\x1b[0m"
+	attrMatch     = "\x1b[7m"
+	attrVisual    = "\x1b[7m"
+	attrSearch    = "\x1b[30;43m"
+	attrIncSearch = "\x1b[7m"
+	attrStatus    = "\x1b[1;7m"
+	attrStatusNC  = "\x1b[7m"
+	attrLineNr    = "\x1b[33m"
+	attrNonText   = "\x1b[1;34m"
+
+	attrTabLine     = "\x1b[4;7m"
+	attrTabLineSel  = "\x1b[1m"
+	attrTabLineFill = "\x1b[7m"
+)
+
+// span is a highlighted region [start, end) of a line's text
+type span struct {
+	start int
+	end   int
+	attr  string
+}
+
 type line struct {
 	text string
 	prev *line
@@ -55,28 +84,32 @@ func walkBack() {
 }
 
 func restore() {
-	move(screenX, screenY)
-}
-
-func clear() {
-	fmt.Print(cursor.ClearEntireScreen())
+	move(textCol()+screenX-1, winRow+screenY-1)
 }
 
 func getchar() byte {
-	var b []byte = make([]byte, 1)
-	os.Stdin.Read(b) //nolint
-	return b[0]
-}
-
-func move(x int, y int) {
-	fmt.Print(cursor.MoveTo(y, x))
+	if queueDepth > 0 {
+		if len(keyQueue) == 0 {
+			return ESCAPE_CODE
+		}
+		c := keyQueue[0]
+		keyQueue = keyQueue[1:]
+		return c
+	}
+	for len(pending) == 0 {
+		pending = append(pending, takeFocusEvents(waitInput(0))...)
+	}
+	idle = false
+	c := pending[0]
+	pending = pending[1:]
+	return c
 }
 
 func left() {
 	if currentLine != nil {
 		if textX > 0 {
 			textX--
-			screenX--
+			setXPos()
 			restore()
 		}
 	}
@@ -86,72 +119,469 @@ func right() {
 	if currentLine != nil {
 		if textX < len(currentLine.text)-1 {
 			textX++
-			screenX++
+			setXPos()
 			restore()
 		}
 	}
 }
 
+// up and down step from the current line rather than finding the line
+// by number, which would walk the buffer from the top
 func up() {
-	if currentLine == nil {
+	if currentLine == nil || currentLine.prev == nil || currentLine.prev == top {
 		return
 	}
-	if screenY > 1 {
-		screenY--
-		currentLine = currentLine.prev
-		lineno--
-	} else if topOfScreen.prev != nil {
-		clear()
-		topOfScreen = topOfScreen.prev
-		currentLine = currentLine.prev
-		lineno--
-		draw()
-	}
-	restore()
+	oldTop := topOfScreen
+	currentLine = currentLine.prev
+	lineno--
+	clampTextX()
+	refresh(oldTop)
 }
 
 func down() {
 	if currentLine == nil || currentLine.next == nil {
 		return
 	}
-	if screenY < height-1 {
-		screenY++
-		currentLine = currentLine.next
-		lineno++
-	} else {
-		clear()
-		topOfScreen = topOfScreen.next
-		currentLine = currentLine.next
-		lineno++
-		draw()
+	oldTop := topOfScreen
+	currentLine = currentLine.next
+	lineno++
+	clampTextX()
+	refresh(oldTop)
+}
+
+// numLines is how many lines the buffer has, kept by the functions that
+// link lines in and out
+var numLines int
+
+// lineGen changes whenever lines are linked into or out of the buffer, so
+// that an index worked out before can be trusted while it stays the same.
+// linkGens numbers the changes to every buffer, keeping each value unique.
+var lineGen int
+var linkGens int
+
+// topPosition remembers n, the index of l, while the buffer is as it was
+// at gen
+type topPosition struct {
+	l   *line
+	n   int
+	gen int
+}
+
+// topPos is the index of topOfScreen, moved along with it when it scrolls
+// and when lines are added or removed above it, so that nothing has to
+// count the lines from the top of the buffer
+var topPos topPosition
+
+// nearLines is how far from topOfScreen changes are looked for, to tell
+// whether they move it
+const nearLines = 1000
+
+func lineCount() int {
+	return numLines
+}
+
+// setTop makes l, the line with index n, the one just above the screen
+func setTop(l *line, n int) {
+	topOfScreen = l
+	topPos = topPosition{l: l, n: n, gen: lineGen}
+}
+
+// topKnown is whether topPos still holds for topOfScreen
+func topKnown() bool {
+	return topPos.l == topOfScreen && topPos.gen == lineGen
+}
+
+// topIndex is the index of topOfScreen, -1 for top
+func topIndex() int {
+	if !topKnown() {
+		setTop(topOfScreen, lineIndex(topOfScreen))
+	}
+	return topPos.n
+}
+
+// aboveTop is whether l comes before topOfScreen, with ok false when it
+// is too far from it to tell
+func aboveTop(l *line) (above bool, ok bool) {
+	down, up := topOfScreen, topOfScreen.prev
+	for i := 0; i < nearLines; i++ {
+		if down == l {
+			return false, true
+		}
+		if up == l {
+			return true, true
+		}
+		if down != nil {
+			down = down.next
+		}
+		if up != nil {
+			up = up.prev
+		}
+	}
+	return false, false
+}
+
+// changeLines records count lines being linked in, or out when it is
+// negative, with shifted telling whether that happens above topOfScreen
+// and ok false when that is not known
+func changeLines(count int, shifted bool, ok bool) {
+	known := topKnown()
+	numLines += count
+	linkGens++
+	lineGen = linkGens
+	if known && ok {
+		topPos.gen = lineGen
+		if shifted {
+			topPos.n += count
+		}
+	}
+}
+
+// linesAdded records count lines about to be linked in after after
+func linesAdded(after *line, count int) {
+	above, ok := aboveTop(after)
+	changeLines(count, above, ok)
+}
+
+// linesRemoved records the count lines first through last about to be
+// unlinked
+func linesRemoved(first *line, last *line, count int) {
+	above, ok := aboveTop(last)
+	if ok && !above {
+		// they are below topOfScreen, unless it is one of them
+		var before bool
+		before, ok = aboveTop(first.prev)
+		ok = ok && !before
+	}
+	changeLines(-count, above, ok)
+}
+
+// nthLine returns the line at the zero based index n, where -1 is top,
+// going there from topOfScreen when that is nearer than the top
+func nthLine(n int) *line {
+	line, i := top, -1
+	if topKnown() && abs(n-topPos.n) < n+1 {
+		line, i = topOfScreen, topPos.n
+	}
+	for ; i > n && line != top; i-- {
+		line = line.prev
+	}
+	for ; i < n && line.next != nil; i++ {
+		line = line.next
+	}
+	return line
+}
+
+func lineIndex(target *line) int {
+	if target == topOfScreen && topKnown() {
+		return topPos.n
+	}
+	i := -1
+	for line := top; line != nil; line = line.next {
+		if line == target {
+			return i
+		}
+		i++
+	}
+	return -1
+}
+
+// textRows is the number of screen rows the current window has for text
+func textRows() int {
+	return winRows
+}
+
+// firstVisible is the index of the line shown on the first row. The line
+// topOfScreen itself sits just above the screen.
+func firstVisible() int {
+	return topIndex() + 1
+}
+
+func setFirstVisible(first int) {
+	if count := lineCount(); first > count-1 {
+		first = count - 1
+	}
+	if first < 0 {
+		first = 0
+	}
+	setTop(nthLine(first-1), first-1)
+}
+
+func scrollOff() int {
+	so := optNumber("scrolloff")
+	if limit := (textRows() - 1) / 2; so > limit {
+		so = limit
+	}
+	return so
+}
+
+// keepCursorVisible scrolls the screen just enough for the cursor line to
+// be at least 'scrolloff' lines away from the top and bottom edges
+func keepCursorVisible() {
+	if row, ok := scrollTowardsCursor(); ok {
+		screenY = row
+		return
+	}
+	first := firstVisible()
+	so := scrollOff()
+	want := lineno - so
+	if want < 0 {
+		want = 0
+	}
+	if want < first {
+		first = want
+	}
+	want = lineno + so
+	if count := lineCount(); want > count-1 {
+		want = count - 1
+	}
+	first = max(first, topLineFor(want))
+	setFirstVisible(first)
+	screenY = lineRow(lineno)
+}
+
+// setCursor moves the cursor to line n without scrolling
+func setCursor(n int) {
+	count := lineCount()
+	if count == 0 {
+		return
+	}
+	if n > count-1 {
+		n = count - 1
+	}
+	if n < 0 {
+		n = 0
+	}
+	lineno = n
+	currentLine = nthLine(n)
+	clampTextX()
+}
+
+// clampTextX keeps the cursor on a character of the current line
+func clampTextX() {
+	if textX > len(currentLine.text)-1 {
+		textX = len(currentLine.text) - 1
+	}
+	if textX < 0 {
+		textX = 0
+	}
+}
+
+// refresh scrolls to the cursor and redraws if the screen moved since
+// topOfScreen was oldTop
+func refresh(oldTop *line) {
+	if currentLine == nil {
+		return
+	}
+	keepCursorVisible()
+	setXPos()
+	if topOfScreen != oldTop {
+		redraw()
 	}
 	restore()
 }
 
-func startOfLine() {
-	screenX = 1
+func jumpTo(n int) {
+	oldTop := topOfScreen
+	setCursor(n)
+	refresh(oldTop)
+}
+
+func firstNonBlank() {
 	textX = 0
+	if currentLine == nil {
+		return
+	}
+	for textX < len(currentLine.text)-1 {
+		c := currentLine.text[textX]
+		if c != ' ' && c != '\t' {
+			break
+		}
+		textX++
+	}
+	setXPos()
 	restore()
-	draw()
 }
 
-func displayLineno() {
-	move(60, height)
-	fmt.Print("            ")
-	move(60, height)
-	fmt.Printf("%d - %d", screenX, 1+lineno)
+// lastVisible is the index of the last line wholly on the screen, or
+// the first one if even that does not fit
+func lastVisible() int {
+	first := firstVisible()
+	if !optBool("wrap") {
+		return min(first+textRows()-1, lineCount()-1)
+	}
+	last, rows := first, 0
+	for l, n := topOfScreen.next, first; l != nil; l, n = l.next, n+1 {
+		rows += lineRows(l.text)
+		if rows > textRows() {
+			break
+		}
+		last = n
+	}
+	return last
+}
+
+// bottomLine is the line to keep the cursor above when scrolling: the
+// last one on the screen, less 'scrolloff' unless the end of the buffer
+// is showing
+func bottomLine() int {
+	last := lastVisible()
+	if last < lineCount()-1 {
+		last -= scrollOff()
+	}
+	return last
+}
+
+// screenJump implements H, M and L
+func screenJump(c byte) {
+	first := firstVisible()
+	last := lastVisible()
+	so := scrollOff()
+	n := first
+	switch c {
+	case 'H':
+		if first > 0 {
+			n = first + so
+		}
+	case 'M':
+		n = (first + last) / 2
+	case 'L':
+		n = last
+		if last < lineCount()-1 {
+			n = last - so
+		}
+	}
+	jumpTo(n)
+	firstNonBlank()
+}
+
+// scrollScreen moves the screen by n lines, dragging the cursor along
+// only when it would otherwise leave the screen (Ctrl-E and Ctrl-Y)
+func scrollScreen(n int) {
+	oldTop := topOfScreen
+	setFirstVisible(firstVisible() + n)
+	first := firstVisible()
+	so := scrollOff()
+	if first == 0 {
+		so = 0
+	}
+	if lineno < first+so {
+		setCursor(first + so)
+	} else if last := bottomLine(); lineno > last {
+		setCursor(last)
+	}
+	refresh(oldTop)
+}
+
+func scrollAmount() int {
+	if n := optNumber("scroll"); n > 0 {
+		return n
+	}
+	return textRows() / 2
+}
+
+// halfPage moves both the screen and the cursor (Ctrl-D and Ctrl-U)
+func halfPage(dir int) {
+	if currentLine == nil {
+		return
+	}
+	oldTop := topOfScreen
+	amount := scrollAmount()
+	first := firstVisible()
+	if dir > 0 {
+		if lineno == lineCount()-1 {
+			return
+		}
+		maxFirst := topLineFor(lineCount() - 1)
+		if first+amount < maxFirst {
+			first += amount
+		} else if first < maxFirst {
+			first = maxFirst
+		}
+	} else {
+		if lineno == 0 {
+			return
+		}
+		first -= amount
+	}
+	setFirstVisible(first)
+	setCursor(lineno + dir*amount)
+	refresh(oldTop)
+	firstNonBlank()
+}
+
+// fullPage scrolls forward or backward a screen, keeping two lines of
+// context (Ctrl-F and Ctrl-B)
+func fullPage(dir int) {
+	if currentLine == nil {
+		return
+	}
+	oldTop := topOfScreen
+	amount := textRows() - 2
+	if amount < 1 {
+		amount = 1
+	}
+	setFirstVisible(firstVisible() + dir*amount)
+	first := firstVisible()
+	if dir > 0 {
+		setCursor(first + scrollOff())
+	} else {
+		setCursor(bottomLine())
+	}
+	refresh(oldTop)
+	firstNonBlank()
+}
+
+// zHandle positions the cursor line on the screen: zt, zz and zb, and
+// z<CR>, z. and z- which also move to the first non-blank. With 'nowrap'
+// zh, zl, zH, zL, zs and ze scroll sideways.
+func zHandle() {
+	if currentLine == nil {
+		return
+	}
+	c := getchar()
+	first := firstVisible()
+	rows := lineRows(currentLine.text)
+	switch c {
+	case 't', ENTER_CODE:
+		first = lineAbove(lineno, scrollOff())
+	case 'z', '.':
+		first = lineAbove(lineno, (textRows()-rows)/2)
+	case 'b', '-':
+		first = lineAbove(lineno, textRows()-rows-scrollOff())
+	case 'h', 'l', 'H', 'L', 's', 'e':
+		sideScroll(c)
+		return
+	default:
+		flash(fmt.Sprintf("unknown command 'z%c'", c))
+		return
+	}
+	setFirstVisible(first)
+	refresh(nil)
+	if c == ENTER_CODE || c == '.' || c == '-' {
+		firstNonBlank()
+	}
+}
+
+func startOfLine() {
+	textX = 0
+	setXPos()
 	restore()
+	draw()
 }
 
+// flash shows msg on the message line, in place of what was there
 func flash(msg string) {
+	if len(msg) > width-1 && width > 1 {
+		msg = msg[:width-1]
+	}
 	move(1, height)
-	fmt.Print(msg)
+	paint(msg)
+	clearLineRight()
 	restore()
 }
 
 func clearBanner() {
-	flash("                                                              ")
-	restore()
+	flash("")
 }
 
 func deleteChar(pos int) {
@@ -165,11 +595,11 @@ func deleteChar(pos int) {
 		currentLine.text = txt[1:]
 	}
 	walkBack()
-	clear()
-	draw()
+	redraw()
 }
 
 func deleteLine(line *line) {
+	linesRemoved(line, line, 1)
 	prev := line.prev
 	next := line.next
 	if prev != nil {
@@ -180,7 +610,117 @@ func deleteLine(line *line) {
 	}
 }
 
-func backspace() {
+// insertLinesAfter links new lines holding texts after the line after,
+// returning the last one
+func insertLinesAfter(after *line, texts []string) *line {
+	linesAdded(after, len(texts))
+	for _, text := range texts {
+		newline := lineNew()
+		newline.text = text
+		newline.prev = after
+		newline.next = after.next
+		if after.next != nil {
+			after.next.prev = newline
+		}
+		after.next = newline
+		after = newline
+	}
+	return after
+}
+
+// removeLines unlinks the lines with indexes first through last, always
+// leaving at least one (empty) line in the buffer
+func removeLines(first int, last int) {
+	visible := firstVisible()
+	start := nthLine(first)
+	end := nthLine(last)
+	linesRemoved(start, end, last-first+1)
+	start.prev.next = end.next
+	if end.next != nil {
+		end.next.prev = start.prev
+	}
+	if top.next == nil {
+		insertLinesAfter(top, []string{""})
+	}
+	setFirstVisible(visible)
+	setCursor(first)
+}
+
+func pasteLines(texts []string) {
+	if currentLine == nil {
+		return
+	}
+	insertLinesAfter(currentLine, texts)
+	oldTop := topOfScreen
+	setCursor(lineno + 1)
+	redraw()
+	refresh(oldTop)
+	firstNonBlank()
+}
+
+func indentWidth(text string) int {
+	w := 0
+	for _, c := range text {
+		if c == ' ' {
+			w++
+		} else if c == '\t' {
+			w = (w/tabStop() + 1) * tabStop()
+		} else {
+			break
+		}
+	}
+	return w
+}
+
+func makeIndent(w int) string {
+	if optBool("expandtab") {
+		return strings.Repeat(" ", w)
+	}
+	return strings.Repeat("\t", w/tabStop()) + strings.Repeat(" ", w%tabStop())
+}
+
+// tabStop is the 'tabstop' option, which a bad value cannot make zero
+func tabStop() int {
+	if ts := optNumber("tabstop"); ts > 0 {
+		return ts
+	}
+	return 8
+}
+
+// shiftLine changes the indent of l by dir times 'shiftwidth'
+func shiftLine(l *line, dir int) {
+	if l.text == "" {
+		return
+	}
+	w := indentWidth(l.text) + dir*optNumber("shiftwidth")
+	if w < 0 {
+		w = 0
+	}
+	l.text = makeIndent(w) + strings.TrimLeft(l.text, " \t")
+}
+
+// joinLines joins the count lines starting at l into l, separated by a
+// single space in place of leading white space
+func joinLines(l *line, count int) {
+	for i := 1; i < count && l.next != nil; i++ {
+		next := l.next
+		text := strings.TrimLeft(next.text, " \t")
+		if text != "" && l.text != "" && !strings.HasSuffix(l.text, " ") &&
+			!strings.HasPrefix(text, ")") {
+			l.text += " "
+		}
+		l.text += text
+		deleteLine(next)
+	}
+}
+
+// backspace deletes the character before the cursor, joining the line to
+// the one above at its start. At the start of the buffer it does nothing,
+// reporting false.
+func backspace() bool {
+	if lineno == 0 && textX == 0 {
+		return false
+	}
 	if len(currentLine.text) == 0 {
 		deleteLine(currentLine)
 		up()
@@ -205,23 +745,35 @@ func backspace() {
 	} else if textX != 0 {
 		deleteChar(textX)
 	}
+	return true
 }
 
-func insert() {
-	clear()
-	draw()
+// insert runs insert mode, reporting whether anything was typed or deleted
+func insert() (changed bool) {
+	inserting = true
+	defer func() {
+		inserting = false
+	}()
+	setXPos()
+	redraw()
 	flash("-- INSERT --")
 	defer clearBanner()
 
-	clipboard = currentLine.text
+	typed := ""
+	defer func() {
+		lastInserted = typed
+	}()
 
 	for {
+		drawStatusLines()
 		c := getchar()
 		switch c {
 		case ESCAPE_CODE:
 			walkBack()
 			return
 		case ENTER_CODE:
+			typed += "\n"
+			changed = true
 			prevText := currentLine.text
 			var nextText string
 			if len(currentLine.text) >= textX {
@@ -230,28 +782,28 @@ func insert() {
 			}
 			startOfLine()
 
-			newLine := lineNew()
-
-			newLine.next = currentLine
-			newLine.prev = currentLine.prev
-			newLine.text = nextText
+			newLine := insertLinesAfter(currentLine.prev, []string{nextText})
 			currentLine.text = prevText
-			currentLine.prev.next = newLine
-			currentLine.prev = newLine
 			currentLine = newLine
 			down()
-			clear()
-			draw()
+			redraw()
 		case BACKSPACE_CODE:
-			backspace()
+			if !backspace() {
+				break
+			}
+			if len(typed) > 0 {
+				typed = typed[:len(typed)-1]
+			}
+			changed = true
+			refresh(topOfScreen)
 		default:
+			typed += string(c)
+			changed = true
 			// add character to string at proper position
 			pos := textX
 			txt := currentLine.text
 			if pos == len(currentLine.text) {
 				currentLine.text = fmt.Sprintf("%s%c", txt, c)
-				textX++
-				screenX++
 			} else {
 				currentLine.text = fmt.Sprintf(
 					"%s%c%s",
@@ -260,87 +812,10 @@ func insert() {
 					txt[pos:],
 				)
 			}
-			if c == '\t' {
-				screenX += 7
-			}
-			displayLine(currentLine.text, screenY)
-			right()
-		}
-	}
-}
-
-func executeSearch(term string) {
-	if currentLine == nil {
-		return
-	}
-	i := lineno + 1
-	for line := currentLine.next; line != nil; line = line.next {
-		if strings.Contains(line.text, term) {
-			goToNumber(i + 1)
-			return
-		}
-		i++
-	}
-	flash(fmt.Sprintf("could not find '%s'", term))
-}
-
-func executeReverseSearch(term string) {
-	if currentLine == nil {
-		return
-	}
-
-	i := lineno
-	for line := currentLine.prev; line != nil; line = line.prev {
-		if i <= 0 {
-			flash(fmt.Sprintf("could not find '%s'", term))
-			break
-		}
-		if strings.Contains(line.text, term) {
-			goToNumber(i)
-			return
-		}
-		i--
-	}
-	flash(fmt.Sprintf("could not find '%s'", term))
-}
-
-func search() {
-	oldScreenX := screenX
-	oldScreenY := screenY
-
-	defer func() {
-		screenX = oldScreenX
-	}()
-	defer func() {
-		screenY = oldScreenY
-	}()
-
-	screenY = height
-	screenX = 2
-
-	clearBanner()
-	term := "/"
-	for {
-		flash(term)
-		c := getchar()
-		switch c {
-		case ENTER_CODE:
-			searchTerm = term[1:]
-			executeSearch(searchTerm)
-			return
-		case ESCAPE_CODE:
-			clearBanner()
-			return
-		case BACKSPACE_CODE:
-			term = term[:len(term)-1]
-			screenX--
-			clearBanner()
-			if screenX == 1 {
-				return
-			}
-		default:
-			term += string(c)
-			screenX++
+			textX++
+			oldTop := topOfScreen
+			redrawLine(currentLine)
+			refresh(oldTop)
 		}
 	}
 }
@@ -353,125 +828,87 @@ func abs(x int) int {
 }
 
 func goToNumber(gotoNum int) {
-	linesAway := gotoNum - lineno - 1
-	if linesAway > 0 {
-		for i := 0; i < linesAway; i++ {
-			down()
-		}
-	} else if linesAway < 0 {
-		for i := 0; i < abs(linesAway); i++ {
-			up()
-		}
-	}
+	jumpTo(gotoNum - 1)
 }
 
-func execute(cmd string) {
-	// is it a number?
-	if gotoNum, err := strconv.Atoi(cmd); err == nil {
-		goToNumber(gotoNum)
+func command() {
+	commandWith("")
+}
+
+// commandWith opens the command line with initial already typed
+func commandWith(initial string) {
+	cmd, ok := readLine(":", &commandHistory, initial, nil)
+	clearBanner()
+	if !ok {
 		return
 	}
+	lastCommand = cmd
+	execute(cmd)
+}
 
-	// execute each letter command
-	for _, c := range cmd {
-		switch c {
-		case 'w':
-			writeFile()
-		case 'q':
-			quit = true
-		default:
-			clearBanner()
-			flash(fmt.Sprintf(": unknown command: '%c'", c))
-			return
+func spanAttr(spans []span, i int) string {
+	attr := ""
+	for _, s := range spans {
+		if i >= s.start && i < s.end {
+			attr = s.attr
 		}
 	}
+	return attr
 }
 
-func command() {
-	oldScreenX := screenX
-	oldScreenY := screenY
-
-	defer func() {
-		screenX = oldScreenX
-	}()
-	defer func() {
-		screenY = oldScreenY
-	}()
-
-	screenY = height
-	screenX = 2
-	clearBanner()
-	cmd := ":"
-	for {
-		flash(cmd)
-		c := getchar()
-		switch c {
-		case ENTER_CODE:
-			execute(cmd[1:])
-			return
-		case ESCAPE_CODE:
-			clearBanner()
-			return
-		case BACKSPACE_CODE:
-			cmd = cmd[:len(cmd)-1]
-			screenX--
-			clearBanner()
-			if screenX == 1 {
-				return
-			}
-		default:
-			cmd += string(c)
-			screenX++
-		}
-		draw()
-	}
+// lineHighlights collects the highlighted regions of l, the nth line
+func lineHighlights(l *line, n int) []span {
+	spans := searchHighlights(l, n)
+	spans = append(spans, visualHighlights(l, n)...)
+	spans = append(spans, substituteHighlights(l)...)
+	return append(spans, matchHighlights(l)...)
 }
 
-func writeFile() {
-	file, err := os.Create(filename)
-	if err != nil {
-		flash(fmt.Sprintf("failed to write: '%s': %v", filename, err))
+// redrawLine repaints l if it is on the screen. With 'wrap' a change to
+// it can move the lines below, so the whole window is drawn again.
+func redrawLine(l *line) {
+	if optBool("wrap") {
+		draw()
 		return
 	}
-	defer file.Close()
-
-	for line := top.next; line != nil; line = line.next {
-		file.Write([]byte(line.text)) //nolint
-		file.Write([]byte("\n"))      //nolint
+	n := lineIndex(l)
+	row := n - firstVisible() + 1
+	if row >= 1 && row <= textRows() {
+		drawLine(l, n, row)
 	}
-	flash(fmt.Sprintf("wrote file: \"%s\"", filename))
+	restore()
 }
 
-func displayLine(line string, y int) {
-	move(1, y)
-	fmt.Print("                                                           ")
-	move(1, y)
-	for i, c := range line {
-		if i == width {
-			break
-		}
-		if c == '\t' {
-			fmt.Print("        ")
-		} else {
-			fmt.Printf("%c", c)
-		}
-	}
-	restore()
+func redraw() {
+	clear()
+	drawWindows()
 }
 
+// draw fills the current window with the lines from topOfScreen down. A
+// line that does not wholly fit at the bottom shows as rows of @, unless
+// it is the only one.
 func draw() {
-	i := 0
-	for line := topOfScreen; line != nil; line = line.next {
-		if i >= height {
+	i := 1
+	n := firstVisible()
+	line := topOfScreen.next
+	for ; line != nil && i <= textRows(); line = line.next {
+		rows := lineRows(line.text)
+		if i > 1 && i+rows-1 > textRows() {
 			break
 		}
-		displayLine(line.text, i)
-		i++
+		drawLine(line, n, i)
+		i += rows
+		n++
 	}
 
-	for ; i < height; i++ {
-		displayLine("~", i)
+	for ; i <= textRows(); i++ {
+		if line != nil {
+			drawCutLine(i)
+		} else {
+			drawFiller(i)
+		}
 	}
+	restore()
 }
 
 func min(a int, b int) int {
@@ -482,32 +919,49 @@ func min(a int, b int) int {
 	}
 }
 
+func max(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// setXPos works out where on the screen the cursor goes for textX, which
+// in insert mode can be just past the end of the line. With 'wrap' that
+// can be on a later row of the line; with 'nowrap' the window scrolls
+// sideways to keep the cursor on it.
 func setXPos() {
 	screenX = 1
 	if currentLine == nil {
 		return
 	}
-	for i := 0; i < min(textX, len(currentLine.text)-1); i++ {
-		c := currentLine.text[i]
-		if c == '\t' {
-			screenX += 8
-		} else {
-			screenX++
-		}
+	text := currentLine.text
+	x := min(textX, len(text)-1)
+	if inserting {
+		x = min(textX, len(text))
+	}
+	vcol := virtCol(text, max(x, 0))
+	if !optBool("wrap") {
+		scrollSideways(vcol)
+		screenX = vcol - leftCol + 1
+		return
+	}
+	segs := segments(text)
+	i := segmentAt(segs, x)
+	screenX = vcol - segs[i].vcol + prefixWidth(i) + 1
+	if screenX > textCols() {
+		// just past the end of a line that fills its last row
+		screenX = prefixWidth(1) + 1
+		i++
+	}
+	if row := screenRow(currentLine); row > 0 {
+		screenY = min(row+i, textRows())
 	}
 }
 
 func goToTop() {
-	clear()
-	currentLine = top.next
-	topOfScreen = top
-	screenX = 1
-	screenY = 1
 	textX = 0
-	lineno = 0
-	move(screenX, screenY)
-	draw()
-	restore()
+	jumpTo(0)
 }
 
 func gHandle() {
@@ -515,15 +969,23 @@ func gHandle() {
 	switch c {
 	case 'g':
 		goToTop()
+	case '&':
+		execute("%s//~/&")
+	case 't':
+		cycleTab(1)
+	case 'T':
+		cycleTab(-1)
+	case 'j':
+		displayLineMove(1)
+	case 'k':
+		displayLineMove(-1)
 	default:
 		flash(fmt.Sprintf("unknown command 'g%c'", c))
 	}
 }
 
 func GHandle() {
-	for line := currentLine; line.next != nil; line = line.next {
-		down()
-	}
+	jumpTo(lineCount() - 1)
 }
 
 func dHandle() {
@@ -531,12 +993,15 @@ func dHandle() {
 		c := getchar()
 		switch c {
 		case 'd':
-			clipboard = currentLine.text
-			oldLine := currentLine
-			up()
-			deleteLine(oldLine)
-			clear()
-			draw()
+			if !canStore() {
+				return
+			}
+			saveUndo()
+			deleteText([]string{currentLine.text}, linewise)
+			removeLines(lineno, lineno)
+			redraw()
+			refresh(nil)
+			firstNonBlank()
 			return
 		default:
 			flash(fmt.Sprintf("unknown command: 'd%c'", c))
@@ -550,7 +1015,10 @@ func yHandle() {
 		c := getchar()
 		switch c {
 		case 'y':
-			clipboard = currentLine.text
+			if !canStore() {
+				return
+			}
+			yankText([]string{currentLine.text}, linewise)
 			return
 		default:
 			flash(fmt.Sprintf("unknown command: 'y%c'", c))
@@ -592,110 +1060,189 @@ func wHandle() {
 	}
 }
 
-func scan() {
-	draw()
-	for {
-		if quit {
-			return
+// motion moves the cursor for the commands shared by normal and visual
+// mode, returning false if c is not one of them
+func motion(c byte) bool {
+	switch c {
+	case 'l':
+		right()
+	case 'h':
+		left()
+	case 'j':
+		down()
+	case 'k':
+		up()
+	case 'g':
+		gHandle()
+	case 'G':
+		GHandle()
+	case '$':
+		fallthrough
+	case 'E':
+		if currentLine == nil {
+			break
 		}
-		displayLineno()
+		textX = len(currentLine.text) - 1
+	case 'w':
+		wHandle()
+	case 'n':
+		executeSearch(searchTerm)
+	case 'N':
+		executeReverseSearch(searchTerm)
+	case '/', '?':
+		search(c)
+	case '*':
+		starSearch(true)
+	case '#':
+		starSearch(false)
+	case '0':
+		startOfLine()
+	case '%':
+		percentJump()
+	case 'H', 'M', 'L':
+		screenJump(c)
+	case 'z':
+		zHandle()
+	case '\'', '`':
+		markJump(c)
+	case CTRL_E_CODE:
+		scrollScreen(1)
+	case CTRL_Y_CODE:
+		scrollScreen(-1)
+	case CTRL_D_CODE:
+		halfPage(1)
+	case CTRL_U_CODE:
+		halfPage(-1)
+	case CTRL_F_CODE:
+		fullPage(1)
+	case CTRL_B_CODE:
+		fullPage(-1)
+	default:
+		return false
+	}
+	return true
+}
 
-		c := getchar()
+func scan() {
+	drawWindows()
+	for !quit {
+		drawOtherWindows()
+		drawTabLine()
+		drawRelativeNumbers()
+		drawStatusLines()
+		idle = true
+		normalCommand()
+	}
+}
 
-		switch c {
-		case 'l':
-			right()
-		case 'h':
-			left()
-		case 'j':
-			down()
-		case 'k':
-			up()
-		case 'u':
-			currentLine.text = clipboard
-			startOfLine()
-		case 'i':
-			insert()
-		case 'g':
-			gHandle()
-		case 'G':
-			GHandle()
-		case '$':
-			fallthrough
-		case 'E':
-			if currentLine == nil {
-				break
-			}
-			textX = len(currentLine.text) - 1
-		case 'A':
-			if len(currentLine.text) == 0 {
-				insert()
-			} else {
-				textX = len(currentLine.text)
-				setXPos()
-				screenX++
-				insert()
-			}
-		case 'o':
-			newline := lineNew()
-			newline.prev = currentLine
-			newline.next = currentLine.next
-			currentLine.next = newline
-			down()
-			startOfLine()
-			clear()
-			draw()
-			insert()
-		case 'r':
-			clipboard = currentLine.text
-			char := getchar()
-			txt := currentLine.text
-			currentLine.text = fmt.Sprintf(
-				"%s%c%s",
-				txt[:textX],
-				char,
-				txt[textX+1:],
-			)
-		case 'w':
-			wHandle()
-		case 'p':
-			oldNext := currentLine.next
-			newline := lineNew()
-			newline.text = clipboard
-			newline.prev = currentLine
-			newline.next = oldNext
-			oldNext.prev = newline
-			currentLine.next = newline
-		case 'y':
-			yHandle()
-		case 'd':
-			dHandle()
-		case 'D':
-			clipboard = currentLine.text
-			currentLine.text = currentLine.text[:textX]
-		case 'x':
-			clipboard = currentLine.text
-			deleteChar(textX + 1)
-			right()
-		case 'n':
-			executeSearch(searchTerm)
-		case 'N':
-			executeReverseSearch(searchTerm)
-		case '/':
-			search()
-		case ':':
-			command()
-		case '0':
-			startOfLine()
-		case ESCAPE_CODE:
-			break // do nothing
-		default:
+// normalCommand reads and carries out one normal mode command
+func normalCommand() {
+	c := normalKey()
+	searchCount = ""
+
+	switch c {
+	case 'u':
+		undo()
+	case CTRL_R_CODE:
+		redo()
+	case CTRL_CARET:
+		alternateBuffer()
+	case CTRL_L_CODE:
+		resumeScreen()
+		redraw()
+	case CTRL_W_CODE:
+		windowCommand()
+	case 'i':
+		saveUndo()
+		if !insert() {
+			dropUndo()
+		}
+	case 'A':
+		saveUndo()
+		textX = len(currentLine.text)
+		if !insert() {
+			dropUndo()
+		}
+	case 'o':
+		saveUndo()
+		insertLinesAfter(currentLine, []string{""})
+		down()
+		startOfLine()
+		redraw()
+		insert()
+	case 'r':
+		char := getchar()
+		if char == ESCAPE_CODE || len(currentLine.text) == 0 {
+			break
+		}
+		saveUndo()
+		txt := currentLine.text
+		currentLine.text = fmt.Sprintf(
+			"%s%c%s",
+			txt[:textX],
+			char,
+			txt[textX+1:],
+		)
+		redrawLine(currentLine)
+	case 'm':
+		mHandle()
+	case 'p':
+		put(true)
+	case 'P':
+		put(false)
+	case '"':
+		selectRegister()
+		return
+	case 'y':
+		yHandle()
+	case 'd':
+		dHandle()
+	case 'D':
+		if len(currentLine.text) == 0 || !canStore() {
+			break
+		}
+		saveUndo()
+		deleteText([]string{currentLine.text[textX:]}, charwise)
+		currentLine.text = currentLine.text[:textX]
+		walkBack()
+		redrawLine(currentLine)
+	case 'x':
+		if len(currentLine.text) == 0 || !canStore() {
+			break
+		}
+		saveUndo()
+		deleteText([]string{currentLine.text[textX : textX+1]}, charwise)
+		x := textX
+		deleteChar(textX + 1)
+		textX = x
+		setCursor(lineno)
+	case ':':
+		command()
+	case '&':
+		execute("s")
+	case '!':
+		bangHandle()
+	case 'Z':
+		ZHandle()
+	case 'v', 'V', CTRL_V_CODE:
+		visual(c)
+	case ESCAPE_CODE:
+		break // do nothing
+	default:
+		if !motion(c) {
 			flash(fmt.Sprintf("unknown command: '%c'", c))
 		}
-		setXPos()
 	}
+	pendingRegister = 0
+	setXPos()
+	updateParenMatch()
 }
 
+// cookedIn and cookedOut are the terminal modes from before the editor
+// started, for running programs that use the terminal
+var cookedIn *term.State
+var cookedOut *term.State
+
 func eventLoop() error {
 	var err error
 
@@ -704,63 +1251,69 @@ func eventLoop() error {
 		return err
 	}
 
-	oldIn, err := term.MakeRaw(int(os.Stdin.Fd()))
+	cookedIn, err = term.MakeRaw(int(os.Stdin.Fd()))
 	if err != nil {
 		return err
 	}
-	defer term.Restore(int(os.Stdin.Fd()), oldIn) //nolint
+	defer term.Restore(int(os.Stdin.Fd()), cookedIn) //nolint
 
-	oldOut, err := term.MakeRaw(int(os.Stdout.Fd()))
+	cookedOut, err = term.MakeRaw(int(os.Stdout.Fd()))
 	if err != nil {
 		return err
 	}
-	defer term.Restore(int(os.Stdout.Fd()), oldOut) //nolint
+	defer term.Restore(int(os.Stdout.Fd()), cookedOut) //nolint
+
+	go readInput()
+	fmt.Print(focusReportingOn)
+	defer fmt.Print(focusReportingOff)
 
+	layoutWindows()
 	clear()
-	move(screenX, screenY)
+	restore()
 	scan()
 	return nil
 }
 
 func initialSetup() {
 	top = lineNew()
-	currentLine = lineNew()
-	top.next = currentLine
-	currentLine.prev = top
-	topOfScreen = top
-}
-
-func readFile(filename string) {
-	readFile, err := os.Open(filename)
-	if err != nil {
-		return // file does not exist, so we'll create a new one
-	}
-	defer readFile.Close()
-
-	top = lineNew()
-	lines := top
-
-	fileScanner := bufio.NewScanner(readFile)
-	fileScanner.Split(bufio.ScanLines)
-	for fileScanner.Scan() {
-		line := lineNew()
-		line.text = fileScanner.Text()
-		lines.next = line
-		line.prev = lines
-		lines = lines.next
-	}
-	currentLine = top.next
 	topOfScreen = top
+	numLines = 0
+	currentLine = insertLinesAfter(top, []string{""})
+	setTop(top, -1)
+	markSaved()
 }
 
 func main() {
 	initialSetup()
-	defer clear()
-	if len(os.Args) > 1 {
-		filename = os.Args[1]
-		readFile(filename)
+	defer clearTerminal()
+	args := os.Args[1:]
+	tabPages := len(args) > 0 && args[0] == "-p"
+	if tabPages {
+		args = args[1:]
+	}
+	argList = args
+	for _, name := range argList {
+		newBuffer(name)
+	}
+	if len(buffers) == 0 {
+		newBuffer("")
+	}
+	if _, err := enterBuffer(buffers[0]); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	curWin = newWindow(curBuf)
+	rootFrame = curWin.frame
+	curTab = &tabpage{root: rootFrame, win: curWin}
+	tabs = []*tabpage{curTab}
+	if tabPages {
+		for i := len(buffers) - 1; i > 0; i-- {
+			addTab(buffers[i])
+		}
 	}
+	loadHistory()
 	err := eventLoop()
+	saveHistory()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		return
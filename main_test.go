@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// startEditor sets the editor up as main does, on a buffer holding lines
+// and an 80 by 24 screen whose output is thrown away
+func startEditor(lines []string) {
+	terminal = io.Discard
+	width, height = 80, 24
+	buffers = nil
+	registers = map[byte]*register{}
+	initialSetup()
+	if _, err := enterBuffer(newBuffer("")); err != nil {
+		panic(err)
+	}
+	setBuffer(lines)
+	markSaved()
+	curWin = newWindow(curBuf)
+	rootFrame = curWin.frame
+	curTab = &tabpage{root: rootFrame, win: curWin}
+	tabs = []*tabpage{curTab}
+	layoutWindows()
+	front = nil
+	clear()
+	drawWindows()
+}
+
+// typeKeys runs keys through the main loop as though typed
+func typeKeys(keys string) {
+	keyQueue = []byte(keys)
+	queueDepth = 1
+	for len(keyQueue) > 0 {
+		drawOtherWindows()
+		drawTabLine()
+		drawRelativeNumbers()
+		drawStatusLines()
+		normalCommand()
+	}
+	queueDepth = 0
+}
+
+// messageLine is what the bottom row of the screen shows
+func messageLine() string {
+	return screenRowText(height)
+}
+
+// screenRowText is what row y of the screen shows, without the spaces
+// at the end
+func screenRowText(y int) string {
+	var b strings.Builder
+	for _, c := range back[y-1] {
+		b.WriteRune(c.ch)
+	}
+	return strings.TrimRight(b.String(), " ")
+}
+
+func TestBackspaceAtStart(t *testing.T) {
+	for _, lines := range [][]string{{""}, {"", "two"}, {"one"}} {
+		startEditor(lines)
+		typeKeys("i\x7f\x7f\x1b")
+		if got := lineTexts(0, lineCount()-1); strings.Join(got, "\n") != strings.Join(lines, "\n") {
+			t.Errorf("backspace at the start changed %q to %q", lines, got)
+		}
+		if isModified() {
+			t.Errorf("backspace at the start of %q modified the buffer", lines)
+		}
+	}
+}
+
+func TestLineBookkeeping(t *testing.T) {
+	lines := make([]string, 200)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d", i)
+	}
+	for _, keys := range []string{
+		"100Gdd", "100G5dd", "100Gyy10p", "100GkkkkkkkkkkkkkkkkkkkkkkkkkkkkkkJ",
+		"100Gofoo\rbar\x1b", "100Gi\r\r\x1b", "100G\x06\x06dd\x02\x02", "100Gddu\x12u",
+		"100G:1,50d\r", ":150,160m0\r", "G:g/1/d\r", "100G:g/./m0\r",
+		"100GVjjjd", "100G:1,10y\r50Gp", "Gdd\x15\x15\x15", "ggdGu",
+	} {
+		startEditor(lines)
+		typeKeys(keys)
+		n := 0
+		for l := top.next; l != nil; l = l.next {
+			n++
+		}
+		if lineCount() != n {
+			t.Errorf("%q: lineCount() = %d, the buffer has %d lines", keys, lineCount(), n)
+		}
+		want := -1
+		for l := top; l != topOfScreen && l != nil; l = l.next {
+			want++
+		}
+		if got := firstVisible() - 1; got != want {
+			t.Errorf("%q: topOfScreen is at %d, counted %d", keys, got, want)
+		}
+		if got := nthLine(lineno); got != currentLine {
+			t.Errorf("%q: line %d is not the cursor line", keys, lineno)
+		}
+	}
+}
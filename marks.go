@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// mark is a position set with m{a-z}, or '<' and '>' for the last visual
+// selection. Marks point at line structs, so they follow their line as
+// others are inserted and deleted above it.
+type mark struct {
+	l *line
+	x int
+}
+
+var marks = map[byte]mark{}
+
+func validMark(c byte) bool {
+	return c >= 'a' && c <= 'z' || c == '<' || c == '>'
+}
+
+func setMark(c byte, l *line, x int) {
+	marks[c] = mark{l: l, x: x}
+}
+
+// markLine is the index of the line mark c is on, or an error if it is
+// unset or its line has been deleted
+func markLine(c byte) (int, error) {
+	m, ok := marks[c]
+	if !ok {
+		return 0, fmt.Errorf("mark not set: '%c'", c)
+	}
+	n := lineIndex(m.l)
+	if n < 0 {
+		delete(marks, c)
+		return 0, fmt.Errorf("mark not set: '%c'", c)
+	}
+	return n, nil
+}
+
+// mHandle sets a mark at the cursor for m{a-z}
+func mHandle() {
+	c := getchar()
+	if c < 'a' || c > 'z' {
+		flash(fmt.Sprintf("invalid mark: '%c'", c))
+		return
+	}
+	setMark(c, currentLine, textX)
+}
+
+// markJump goes to a mark: to its line for ', or its exact position for `
+func markJump(kind byte) {
+	c := getchar()
+	if c == ESCAPE_CODE {
+		return
+	}
+	n, err := markLine(c)
+	if err != nil {
+		flash(err.Error())
+		return
+	}
+	if kind == '\'' {
+		jumpTo(n)
+		firstNonBlank()
+		return
+	}
+	goToPos(n, marks[c].x)
+}
+
+// markList describes the marks for :marks
+func markList() []string {
+	var names []string
+	for c := range marks {
+		names = append(names, string(c))
+	}
+	sort.Strings(names)
+	out := []string{"mark line  col text"}
+	for _, name := range names {
+		n, err := markLine(name[0])
+		if err != nil {
+			continue
+		}
+		out = append(out, fmt.Sprintf(" %s %6d %4d %s", name, n+1, marks[name[0]].x, nthLine(n).text))
+	}
+	return out
+}
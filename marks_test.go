@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestMarkAfterUndo(t *testing.T) {
+	tests := []struct {
+		keys string
+		want string
+	}{
+		{"jjmaggddu'a", "three"},
+		{"jjmaggyyPu'a", "three"},
+		{"jjmaggddu\x12'a", "three"},
+		{"jjmaddu'a", "three"},
+		{"jjmaGddggu'a", "three"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.keys, func(t *testing.T) {
+			startEditor([]string{"one", "two", "three", "four"})
+			typeKeys(tt.keys)
+			if currentLine.text != tt.want {
+				t.Errorf("'a went to %q, want %q", currentLine.text, tt.want)
+			}
+		})
+	}
+}
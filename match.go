@@ -0,0 +1,245 @@
+package main
+
+import (
+	"strings"
+)
+
+type matchPair struct {
+	open  string
+	close string
+}
+
+// matchState is the pair of tokens highlighted while the cursor sits on
+// one of them
+type matchState struct {
+	line      *line
+	x         int
+	size      int
+	matchLine *line
+	matchX    int
+	matchSize int
+}
+
+var parenMatch matchState
+
+func isWordChar(c byte) bool {
+	return c == '_' ||
+		(c >= 'a' && c <= 'z') ||
+		(c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9')
+}
+
+// matchPairs parses the 'matchpairs' option. Besides single characters
+// like "(:)" it accepts words such as "if:end", which only match as
+// whole words.
+func matchPairs() []matchPair {
+	var pairs []matchPair
+	for _, part := range strings.Split(optString("matchpairs"), ",") {
+		i := strings.Index(part, ":")
+		if i <= 0 || i == len(part)-1 {
+			continue
+		}
+		if part[:i] == part[i+1:] {
+			continue
+		}
+		pairs = append(pairs, matchPair{open: part[:i], close: part[i+1:]})
+	}
+	return pairs
+}
+
+func tokenMatches(text string, pos int, tok string) bool {
+	if pos < 0 || !strings.HasPrefix(text[pos:], tok) {
+		return false
+	}
+	if isWordChar(tok[0]) && pos > 0 && isWordChar(text[pos-1]) {
+		return false
+	}
+	end := pos + len(tok)
+	if isWordChar(tok[len(tok)-1]) && end < len(text) && isWordChar(text[end]) {
+		return false
+	}
+	return true
+}
+
+// tokenAt finds the pair token under the cursor, or failing that the first
+// one after it on the line
+func tokenAt(text string, x int, pairs []matchPair) (matchPair, bool, int, bool) {
+	for _, pair := range pairs {
+		for _, open := range []bool{true, false} {
+			tok := pair.close
+			if open {
+				tok = pair.open
+			}
+			for start := x - len(tok) + 1; start <= x; start++ {
+				if tokenMatches(text, start, tok) {
+					return pair, open, start, true
+				}
+			}
+		}
+	}
+	for pos := x + 1; pos < len(text); pos++ {
+		for _, pair := range pairs {
+			if tokenMatches(text, pos, pair.open) {
+				return pair, true, pos, true
+			}
+			if tokenMatches(text, pos, pair.close) {
+				return pair, false, pos, true
+			}
+		}
+	}
+	return matchPair{}, false, 0, false
+}
+
+// findMatch searches from the token at pos on line l for its counterpart,
+// giving up after maxLines lines when maxLines is positive
+func findMatch(l *line, n int, pos int, pair matchPair, open bool, maxLines int) (*line, int, int, bool) {
+	depth := 0
+	scanned := 0
+	if open {
+		for ; l != nil; l = l.next {
+			text := l.text
+			for p := pos; p < len(text); {
+				if tokenMatches(text, p, pair.open) {
+					depth++
+					p += len(pair.open)
+				} else if tokenMatches(text, p, pair.close) {
+					depth--
+					if depth == 0 {
+						return l, n, p, true
+					}
+					p += len(pair.close)
+				} else {
+					p++
+				}
+			}
+			scanned++
+			if maxLines > 0 && scanned >= maxLines {
+				break
+			}
+			pos = 0
+			n++
+		}
+		return nil, 0, 0, false
+	}
+
+	for ; l != nil && l != top; l = l.prev {
+		text := l.text
+		if pos > len(text)-1 {
+			pos = len(text) - 1
+		}
+		for p := pos; p >= 0; p-- {
+			if tokenMatches(text, p, pair.close) {
+				depth++
+			} else if tokenMatches(text, p, pair.open) {
+				depth--
+				if depth == 0 {
+					return l, n, p, true
+				}
+			}
+		}
+		scanned++
+		if maxLines > 0 && scanned >= maxLines {
+			break
+		}
+		if l.prev != nil {
+			pos = len(l.prev.text) - 1
+		}
+		n--
+	}
+	return nil, 0, 0, false
+}
+
+// percentJump implements %
+func percentJump() {
+	if currentLine == nil {
+		return
+	}
+	pairs := matchPairs()
+	pair, open, pos, ok := tokenAt(currentLine.text, textX, pairs)
+	if !ok {
+		return
+	}
+	_, n, x, ok := findMatch(currentLine, lineno, pos, pair, open, 0)
+	if !ok {
+		return
+	}
+	oldTop := topOfScreen
+	setCursor(n)
+	textX = x
+	refresh(oldTop)
+}
+
+func computeParenMatch() matchState {
+	if !optBool("matchparen") || currentLine == nil || textX >= len(currentLine.text) {
+		return matchState{}
+	}
+	pairs := matchPairs()
+	for _, pair := range pairs {
+		for _, open := range []bool{true, false} {
+			tok := pair.close
+			if open {
+				tok = pair.open
+			}
+			for start := textX - len(tok) + 1; start <= textX; start++ {
+				if !tokenMatches(currentLine.text, start, tok) {
+					continue
+				}
+				ml, _, mx, ok := findMatch(currentLine, lineno, start, pair, open, textRows())
+				if !ok {
+					return matchState{}
+				}
+				size := len(pair.open)
+				if open {
+					size = len(pair.close)
+				}
+				return matchState{
+					line:      currentLine,
+					x:         start,
+					size:      len(tok),
+					matchLine: ml,
+					matchX:    mx,
+					matchSize: size,
+				}
+			}
+		}
+	}
+	return matchState{}
+}
+
+// updateParenMatch moves the match highlight to follow the cursor,
+// repainting only the lines that changed
+func updateParenMatch() {
+	next := computeParenMatch()
+	if next == parenMatch {
+		return
+	}
+	old := parenMatch
+	parenMatch = next
+	for _, l := range []*line{old.line, old.matchLine, next.line, next.matchLine} {
+		if l != nil {
+			redrawLine(l)
+		}
+	}
+}
+
+func matchHighlights(l *line) []span {
+	var spans []span
+	if parenMatch.line == nil {
+		return spans
+	}
+	if parenMatch.line == l {
+		spans = append(spans, span{
+			start: parenMatch.x,
+			end:   parenMatch.x + parenMatch.size,
+			attr:  attrMatch,
+		})
+	}
+	if parenMatch.matchLine == l {
+		spans = append(spans, span{
+			start: parenMatch.matchX,
+			end:   parenMatch.matchX + parenMatch.matchSize,
+			attr:  attrMatch,
+		})
+	}
+	return spans
+}
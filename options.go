@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type optionKind int
+
+const (
+	boolOption optionKind = iota
+	numberOption
+	stringOption
+)
+
+type option struct {
+	name    string
+	abbrev  string
+	kind    optionKind
+	boolVal bool
+	numVal  int
+	strVal  string
+}
+
+var optionList = []*option{
+	{name: "autoread", abbrev: "ar", kind: boolOption, boolVal: false},
+	{name: "breakat", abbrev: "brk", kind: stringOption, strVal: " ^I!@*-+;:,./?"},
+	{name: "clipboardread", abbrev: "cbr", kind: stringOption, strVal: ""},
+	{name: "clipboardwrite", abbrev: "cbw", kind: stringOption, strVal: ""},
+	{name: "expandtab", abbrev: "et", kind: boolOption, boolVal: false},
+	{name: "history", abbrev: "hi", kind: numberOption, numVal: 50},
+	{name: "hlsearch", abbrev: "hls", kind: boolOption, boolVal: true},
+	{name: "ignorecase", abbrev: "ic", kind: boolOption, boolVal: false},
+	{name: "incsearch", abbrev: "is", kind: boolOption, boolVal: true},
+	{name: "linebreak", abbrev: "lbr", kind: boolOption, boolVal: false},
+	{name: "matchpairs", abbrev: "mps", kind: stringOption, strVal: "(:),{:},[:]"},
+	{name: "matchparen", kind: boolOption, boolVal: true},
+	{name: "number", abbrev: "nu", kind: boolOption, boolVal: false},
+	{name: "numberwidth", abbrev: "nuw", kind: numberOption, numVal: 4},
+	{name: "relativenumber", abbrev: "rnu", kind: boolOption, boolVal: false},
+	{name: "scroll", abbrev: "scr", kind: numberOption, numVal: 0},
+	{name: "scrolloff", abbrev: "so", kind: numberOption, numVal: 0},
+	{name: "shiftwidth", abbrev: "sw", kind: numberOption, numVal: 8},
+	{name: "showbreak", abbrev: "sbr", kind: stringOption, strVal: ""},
+	{name: "sidescroll", abbrev: "ss", kind: numberOption, numVal: 0},
+	{name: "sidescrolloff", abbrev: "siso", kind: numberOption, numVal: 0},
+	{name: "smartcase", abbrev: "scs", kind: boolOption, boolVal: false},
+	{name: "statusline", abbrev: "stl", kind: stringOption, strVal: " %{mode()}  %f %m%r %{searchcount()}%=%y %{&fenc} %{&ff}  %l:%c  %p%% "},
+	{name: "tabstop", abbrev: "ts", kind: numberOption, numVal: 8},
+	{name: "wrap", kind: boolOption, boolVal: true},
+	{name: "wrapscan", abbrev: "ws", kind: boolOption, boolVal: true},
+}
+
+func lookupOption(name string) *option {
+	for _, opt := range optionList {
+		if opt.name == name || opt.abbrev != "" && opt.abbrev == name {
+			return opt
+		}
+	}
+	return nil
+}
+
+func optBool(name string) bool {
+	if opt := lookupOption(name); opt != nil {
+		return opt.boolVal
+	}
+	return false
+}
+
+func optNumber(name string) int {
+	if opt := lookupOption(name); opt != nil {
+		return opt.numVal
+	}
+	return 0
+}
+
+func optString(name string) string {
+	if opt := lookupOption(name); opt != nil {
+		return opt.strVal
+	}
+	return ""
+}
+
+func (opt *option) String() string {
+	switch opt.kind {
+	case boolOption:
+		if opt.boolVal {
+			return opt.name
+		}
+		return "no" + opt.name
+	case numberOption:
+		return fmt.Sprintf("%s=%d", opt.name, opt.numVal)
+	default:
+		return fmt.Sprintf("%s=%s", opt.name, opt.strVal)
+	}
+}
+
+// setOption applies a single argument of :set, e.g. "so=5", "nowrap",
+// "invnumber", "number!" or "scrolloff?". The returned string, if any,
+// is a message to show the user.
+func setOption(arg string) (string, error) {
+	name := arg
+	value := ""
+	hasValue := false
+	op := byte('=')
+
+	if i := strings.IndexAny(arg, "=:"); i >= 0 {
+		name = arg[:i]
+		value = arg[i+1:]
+		hasValue = true
+		if len(name) > 0 && strings.IndexByte("+-^", name[len(name)-1]) >= 0 {
+			op = name[len(name)-1]
+			name = name[:len(name)-1]
+		}
+	}
+
+	if strings.HasSuffix(name, "?") {
+		opt := lookupOption(name[:len(name)-1])
+		if opt == nil {
+			return "", fmt.Errorf("unknown option: %s", name[:len(name)-1])
+		}
+		return opt.String(), nil
+	}
+
+	if opt := lookupOption(name); opt != nil {
+		if !hasValue {
+			if strings.HasSuffix(arg, "!") {
+				return "", fmt.Errorf("invalid argument: %s", arg)
+			}
+			if opt.kind == boolOption {
+				opt.boolVal = true
+				return "", nil
+			}
+			return opt.String(), nil
+		}
+		return "", assignOption(opt, op, value)
+	}
+
+	if strings.HasSuffix(name, "!") && !hasValue {
+		opt := lookupOption(name[:len(name)-1])
+		if opt != nil && opt.kind == boolOption {
+			opt.boolVal = !opt.boolVal
+			return "", nil
+		}
+	}
+	if strings.HasPrefix(name, "no") && !hasValue {
+		opt := lookupOption(name[2:])
+		if opt != nil && opt.kind == boolOption {
+			opt.boolVal = false
+			return "", nil
+		}
+	}
+	if strings.HasPrefix(name, "inv") && !hasValue {
+		opt := lookupOption(name[3:])
+		if opt != nil && opt.kind == boolOption {
+			opt.boolVal = !opt.boolVal
+			return "", nil
+		}
+	}
+	return "", fmt.Errorf("unknown option: %s", name)
+}
+
+func assignOption(opt *option, op byte, value string) error {
+	switch opt.kind {
+	case boolOption:
+		return fmt.Errorf("invalid argument: %s=%s", opt.name, value)
+	case numberOption:
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 && op == '=' {
+			return fmt.Errorf("number required after =: %s=%s", opt.name, value)
+		}
+		switch op {
+		case '+':
+			opt.numVal += n
+		case '-':
+			opt.numVal -= n
+		case '^':
+			opt.numVal *= n
+		default:
+			opt.numVal = n
+		}
+	default:
+		switch op {
+		case '+':
+			if opt.strVal != "" && value != "" {
+				opt.strVal += ","
+			}
+			opt.strVal += value
+		case '^':
+			if opt.strVal != "" && value != "" {
+				value += ","
+			}
+			opt.strVal = value + opt.strVal
+		case '-':
+			parts := strings.Split(opt.strVal, ",")
+			kept := parts[:0]
+			for _, part := range parts {
+				if part != value {
+					kept = append(kept, part)
+				}
+			}
+			opt.strVal = strings.Join(kept, ",")
+		default:
+			opt.strVal = value
+		}
+	}
+	return nil
+}
+
+// splitOptionArgs splits the argument of :set on white space, except where
+// it is escaped with a backslash as in "set cbr=xclip\ -o"
+func splitOptionArgs(arg string) []string {
+	var args []string
+	var current strings.Builder
+	for i := 0; i < len(arg); i++ {
+		c := arg[i]
+		switch {
+		case c == '\\' && i+1 < len(arg):
+			i++
+			current.WriteByte(arg[i])
+		case c == ' ' || c == '\t':
+			if current.Len() > 0 {
+				args = append(args, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteByte(c)
+		}
+	}
+	if current.Len() > 0 {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// setOptions handles the arguments of a :set command
+func setOptions(args []string) {
+	if len(args) == 0 {
+		var parts []string
+		for _, opt := range optionList {
+			parts = append(parts, opt.String())
+		}
+		flash(strings.Join(parts, "  "))
+		return
+	}
+	var msgs []string
+	for _, arg := range args {
+		msg, err := setOption(arg)
+		if err != nil {
+			flash(err.Error())
+			return
+		}
+		if msg != "" {
+			msgs = append(msgs, msg)
+		}
+	}
+	redraw()
+	if len(msgs) > 0 {
+		flash(strings.Join(msgs, "  "))
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	CTRL_C_CODE = 3
+	CTRL_H_CODE = 8
+	TAB_CODE    = 9
+	CTRL_W_CODE = 23
+)
+
+// cmdline is the text being edited on the message line after a : or /
+type cmdline struct {
+	prompt string
+	text   string
+	pos    int
+}
+
+func (c *cmdline) render() {
+	move(1, height)
+	clearLineRight()
+	line := c.prompt + c.text
+	cur := len(c.prompt) + c.pos
+	start := 0
+	if width > 1 && cur+1 > width {
+		start = cur + 1 - width
+	}
+	end := len(line)
+	if width > 0 && end > start+width-1 {
+		end = start + width - 1
+	}
+	paint(line[start:end])
+	move(cur+1-start, height)
+}
+
+func (c *cmdline) insert(s string) {
+	c.text = c.text[:c.pos] + s + c.text[c.pos:]
+	c.pos += len(s)
+}
+
+// deleteWord deletes the word before the cursor, as Ctrl-W does
+func (c *cmdline) deleteWord() {
+	i := c.pos
+	for i > 0 && c.text[i-1] == ' ' {
+		i--
+	}
+	if i > 0 && isWordChar(c.text[i-1]) {
+		for i > 0 && isWordChar(c.text[i-1]) {
+			i--
+		}
+	} else if i > 0 {
+		i--
+	}
+	c.text = c.text[:i] + c.text[c.pos:]
+	c.pos = i
+}
+
+// wordUnderCursor is the word in the buffer at or after the cursor
+func wordUnderCursor() string {
+	if currentLine == nil {
+		return ""
+	}
+	text := currentLine.text
+	start := textX
+	for start < len(text) && !isWordChar(text[start]) {
+		start++
+	}
+	for start > 0 && start <= len(text) && isWordChar(text[start-1]) {
+		start--
+	}
+	end := start
+	for end < len(text) && isWordChar(text[end]) {
+		end++
+	}
+	return text[start:end]
+}
+
+// readLine edits a line on the message line, returning false if it was
+// abandoned. onChange, if not nil, is called with the text after every
+// change.
+func readLine(prompt string, hist *history, initial string, onChange func(string)) (string, bool) {
+	c := &cmdline{prompt: prompt, text: initial, pos: len(initial)}
+	histIndex := len(hist.entries)
+	histPrefix := ""
+	var matches []string
+	matchIndex := 0
+	matchStart := 0
+
+	for {
+		c.render()
+		key := readKey()
+		if key != TAB_CODE {
+			matches = nil
+		}
+		before := c.text
+		switch key {
+		case ENTER_CODE, '\n':
+			hist.add(c.text)
+			return c.text, true
+		case ESCAPE_CODE, CTRL_C_CODE:
+			return "", false
+		case BACKSPACE_CODE, CTRL_H_CODE:
+			if c.text == "" {
+				return "", false
+			}
+			if c.pos > 0 {
+				c.text = c.text[:c.pos-1] + c.text[c.pos:]
+				c.pos--
+			}
+		case KEY_DELETE:
+			if c.pos < len(c.text) {
+				c.text = c.text[:c.pos] + c.text[c.pos+1:]
+			}
+		case KEY_LEFT:
+			if c.pos > 0 {
+				c.pos--
+			}
+		case KEY_RIGHT:
+			if c.pos < len(c.text) {
+				c.pos++
+			}
+		case KEY_HOME, CTRL_B_CODE:
+			c.pos = 0
+		case KEY_END, CTRL_E_CODE:
+			c.pos = len(c.text)
+		case CTRL_W_CODE:
+			c.deleteWord()
+		case CTRL_U_CODE:
+			c.text = c.text[c.pos:]
+			c.pos = 0
+		case CTRL_R_CODE:
+			r := getchar()
+			if r == CTRL_W_CODE {
+				c.insert(wordUnderCursor())
+			} else if validRegister(r) {
+				if reg := getRegister(r); reg != nil {
+					c.insert(strings.Join(reg.text, "\n"))
+				}
+			}
+		case KEY_UP, KEY_DOWN:
+			if histIndex == len(hist.entries) {
+				histPrefix = c.text
+			}
+			i := hist.older(histIndex, histPrefix)
+			if key == KEY_DOWN {
+				i = hist.newer(histIndex, histPrefix)
+			}
+			if i < 0 {
+				break
+			}
+			histIndex = i
+			if i == len(hist.entries) {
+				c.text = histPrefix
+			} else {
+				c.text = hist.entries[i]
+			}
+			c.pos = len(c.text)
+		case TAB_CODE:
+			if prompt != ":" && hist != &fileHistory {
+				c.insert("\t")
+				break
+			}
+			if matches == nil {
+				if prompt == ":" {
+					matchStart, matches = completions(c.text[:c.pos])
+				} else {
+					matchStart, matches = 0, fileCompletions(c.text[:c.pos])
+				}
+				matchIndex = 0
+				if len(matches) == 0 {
+					matches = nil
+					break
+				}
+			} else {
+				matchIndex = (matchIndex + 1) % len(matches)
+			}
+			c.text = c.text[:matchStart] + matches[matchIndex] + c.text[c.pos:]
+			c.pos = matchStart + len(matches[matchIndex])
+		default:
+			if key >= ' ' && key < 256 {
+				c.insert(string(byte(key)))
+			}
+		}
+		if c.text != before && onChange != nil {
+			onChange(c.text)
+		}
+	}
+}
+
+// completions finds what the word before the cursor on the command line
+// could be completed to: a command name, an option for :set, or else a
+// file name. It returns where the word starts along with the candidates.
+func completions(text string) (int, []string) {
+	start := strings.LastIndexAny(text, " \t") + 1
+	word := text[start:]
+	if start == 0 {
+		return 0, matchingCommands(word)
+	}
+
+	fields := strings.Fields(text)
+	if fields[0] == "set" || fields[0] == "se" {
+		if strings.ContainsAny(word, "=:") {
+			return start, nil
+		}
+		var names []string
+		for _, opt := range optionList {
+			names = append(names, opt.name)
+			if opt.kind == boolOption {
+				names = append(names, "no"+opt.name)
+			}
+		}
+		return start, withPrefix(names, word)
+	}
+
+	return start, fileCompletions(word)
+}
+
+// fileCompletions lists the files whose names start with word, marking
+// directories with a trailing separator
+func fileCompletions(word string) []string {
+	found, err := filepath.Glob(globEscape(word) + "*")
+	if err != nil {
+		return nil
+	}
+	for i, name := range found {
+		if info, err := os.Stat(name); err == nil && info.IsDir() {
+			found[i] = name + string(filepath.Separator)
+		}
+	}
+	return found
+}
+
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func withPrefix(names []string, prefix string) []string {
+	var found []string
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			found = append(found, name)
+		}
+	}
+	sort.Strings(found)
+	return found
+}
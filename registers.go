@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type regKind int
+
+const (
+	charwise regKind = iota
+	linewise
+	blockwise
+)
+
+type register struct {
+	text []string
+	kind regKind
+}
+
+// registers holds the writable registers: '"' (unnamed), 'a'-'z', '0'-'9'
+// and '-'. The read-only ones and the clipboard registers '+' and '*' are
+// computed in getRegister.
+var registers = map[byte]*register{}
+
+// pendingRegister is the register chosen with a "x prefix for the next
+// command, 0 meaning none
+var pendingRegister byte
+var lastInserted string
+var lastCommand string
+
+func validRegister(c byte) bool {
+	return c < 128 && (unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)) ||
+		strings.IndexByte("\"-_.:%/+*", c) >= 0)
+}
+
+// readOnlyRegister is whether c can be put from but not yanked or deleted
+// into
+func readOnlyRegister(c byte) bool {
+	return c != 0 && strings.IndexByte(".%:/", c) >= 0
+}
+
+// canStore checks the pending register can take yanked or deleted text,
+// for the commands that do nothing when it cannot
+func canStore() bool {
+	if readOnlyRegister(pendingRegister) {
+		flash(fmt.Sprintf("invalid register: '%c'", pendingRegister))
+		pendingRegister = 0
+		return false
+	}
+	return true
+}
+
+func selectRegister() {
+	c := getchar()
+	if !validRegister(c) {
+		flash(fmt.Sprintf("invalid register: '%c'", c))
+		return
+	}
+	pendingRegister = c
+}
+
+// takeRegister returns and clears the pending register
+func takeRegister() byte {
+	c := pendingRegister
+	pendingRegister = 0
+	return c
+}
+
+func getRegister(c byte) *register {
+	switch {
+	case c == 0:
+		c = '"'
+	case c >= 'A' && c <= 'Z':
+		c += 'a' - 'A'
+	}
+	switch c {
+	case '.':
+		return &register{text: strings.Split(lastInserted, "\n"), kind: charwise}
+	case '%':
+		return &register{text: []string{filename}, kind: charwise}
+	case ':':
+		return &register{text: []string{lastCommand}, kind: charwise}
+	case '/':
+		return &register{text: []string{searchTerm}, kind: charwise}
+	case '+', '*':
+		return getClipboard(c)
+	}
+	return registers[c]
+}
+
+// setRegister stores text in the named register c, appending for the
+// uppercase names, and makes the unnamed register refer to it
+func setRegister(c byte, text []string, kind regKind) {
+	reg := &register{text: text, kind: kind}
+	if c >= 'A' && c <= 'Z' {
+		c += 'a' - 'A'
+		if old := registers[c]; old != nil {
+			reg = appendRegister(old, reg)
+		}
+	}
+	if (c == '+' || c == '*') && !setClipboard(c, reg) {
+		return
+	}
+	registers[c] = reg
+	registers['"'] = reg
+}
+
+func appendRegister(old *register, add *register) *register {
+	reg := &register{kind: old.kind}
+	reg.text = append(reg.text, old.text...)
+	if old.kind == charwise && add.kind == charwise {
+		reg.text[len(reg.text)-1] += add.text[0]
+		reg.text = append(reg.text, add.text[1:]...)
+		return reg
+	}
+	if add.kind == linewise {
+		reg.kind = linewise
+	}
+	reg.text = append(reg.text, add.text...)
+	return reg
+}
+
+// yankText stores yanked text in the pending register, or in "0
+func yankText(text []string, kind regKind) {
+	c := takeRegister()
+	switch c {
+	case '_':
+		return
+	case 0, '"':
+		setRegister('0', text, kind)
+	default:
+		setRegister(c, text, kind)
+	}
+}
+
+// deleteText stores deleted text in the pending register. Without one,
+// deletions within a line go to "- and others shift the "1 to "9 history.
+func deleteText(text []string, kind regKind) {
+	c := takeRegister()
+	switch c {
+	case '_':
+		return
+	case 0, '"':
+		if kind == charwise && len(text) == 1 {
+			setRegister('-', text, kind)
+			return
+		}
+		for i := byte('9'); i > '1'; i-- {
+			if reg := registers[i-1]; reg != nil {
+				registers[i] = reg
+			}
+		}
+		setRegister('1', text, kind)
+	default:
+		setRegister(c, text, kind)
+	}
+}
+
+// put pastes a register after the cursor for p, or before it for P
+func put(after bool) {
+	if currentLine == nil {
+		return
+	}
+	c := takeRegister()
+	reg := getRegister(c)
+	if reg == nil && (c == '+' || c == '*') {
+		return // the clipboard has already reported why
+	}
+	if reg == nil || len(reg.text) == 0 {
+		if c == 0 {
+			c = '"'
+		}
+		flash(fmt.Sprintf("nothing in register %c", c))
+		return
+	}
+	saveUndo()
+	switch reg.kind {
+	case linewise:
+		if after {
+			pasteLines(reg.text)
+		} else {
+			pasteLinesBefore(reg.text)
+		}
+	case blockwise:
+		pasteBlock(reg.text, after)
+	default:
+		pasteChars(reg.text, after)
+	}
+}
+
+func pasteLinesBefore(texts []string) {
+	insertLinesAfter(currentLine.prev, texts)
+	oldTop := topOfScreen
+	setCursor(lineno)
+	redraw()
+	refresh(oldTop)
+	firstNonBlank()
+}
+
+func pasteColumn(after bool) int {
+	col := textX
+	if after && len(currentLine.text) > 0 {
+		col++
+	}
+	if col > len(currentLine.text) {
+		col = len(currentLine.text)
+	}
+	return col
+}
+
+func pasteChars(text []string, after bool) {
+	l := currentLine
+	col := pasteColumn(after)
+	head, tail := l.text[:col], l.text[col:]
+	if len(text) == 1 {
+		l.text = head + text[0] + tail
+		textX = max(col, col+len(text[0])-1)
+	} else {
+		l.text = head + text[0]
+		last := insertLinesAfter(l, text[1:])
+		last.text += tail
+		textX = col
+	}
+	redraw()
+	refresh(nil)
+}
+
+func pasteBlock(text []string, after bool) {
+	col := pasteColumn(after)
+	widest := 0
+	for _, part := range text {
+		if len(part) > widest {
+			widest = len(part)
+		}
+	}
+	l := currentLine
+	prev := l.prev
+	for _, part := range text {
+		if l == nil {
+			l = insertLinesAfter(prev, []string{""})
+		}
+		if len(l.text) < col {
+			l.text += strings.Repeat(" ", col-len(l.text))
+		}
+		if col < len(l.text) {
+			part += strings.Repeat(" ", widest-len(part))
+		}
+		l.text = l.text[:col] + part + l.text[col:]
+		prev = l
+		l = l.next
+	}
+	textX = col
+	redraw()
+	refresh(nil)
+}
+
+// registerList describes the registers named in which, or all of them,
+// for :registers
+func registerList(which string) []string {
+	out := []string{"Type Name Content"}
+	for _, c := range []byte("\"0123456789abcdefghijklmnopqrstuvwxyz-.:%/") {
+		if which != "" && strings.IndexByte(which, c) < 0 {
+			continue
+		}
+		reg := getRegister(c)
+		if reg == nil || len(reg.text) == 0 || (len(reg.text) == 1 && reg.text[0] == "") {
+			continue
+		}
+		kind := "c"
+		switch reg.kind {
+		case linewise:
+			kind = "l"
+		case blockwise:
+			kind = "b"
+		}
+		text := strings.Join(reg.text, "^J")
+		if reg.kind == linewise {
+			text += "^J"
+		}
+		text = strings.ReplaceAll(text, "\t", "^I")
+		out = append(out, fmt.Sprintf("  %s  \"%c   %s", kind, c, text))
+	}
+	return out
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ahmetalpbalkan/go-cursor"
+)
+
+// Drawing goes into back, a grid of cells standing for the screen. When
+// the editor waits for input flush sends the terminal only the cells that
+// differ from front, which is what the terminal shows, in a single write.
+// Drawing everything again costs nothing unless something changed.
+
+type cell struct {
+	ch   rune
+	attr string
+}
+
+var blankCell = cell{ch: ' '}
+
+// terminal is where flush writes the screen
+var terminal io.Writer = os.Stdout
+
+// front is nil when what the terminal shows is not known, so that the
+// next flush clears it and draws every cell
+var front, back [][]cell
+
+// drawX and drawY are where paint draws next and where the cursor is left
+// by flush, and drawAttr the attribute paint draws with
+var drawX, drawY = 1, 1
+var drawAttr string
+
+// shownX and shownY are where the terminal cursor was left by flush
+var shownX, shownY int
+
+// screenSuspended is set while a program run by the editor has the
+// terminal, when flush does nothing
+var screenSuspended bool
+
+// bytesWritten and framesWritten count what flush has sent the terminal
+var bytesWritten, framesWritten int
+
+func makeGrid() [][]cell {
+	grid := make([][]cell, height)
+	for y := range grid {
+		grid[y] = make([]cell, width)
+		for x := range grid[y] {
+			grid[y][x] = blankCell
+		}
+	}
+	return grid
+}
+
+// ensureScreen makes the grids fit the terminal
+func ensureScreen() {
+	if len(back) != height || height > 0 && len(back[0]) != width {
+		back = makeGrid()
+		front = nil
+	}
+}
+
+func move(x int, y int) {
+	drawX, drawY = x, y
+}
+
+func clear() {
+	ensureScreen()
+	for y := range back {
+		for x := range back[y] {
+			back[y][x] = blankCell
+		}
+	}
+}
+
+// clearLineRight blanks the row paint is on from where it is to the end
+func clearLineRight() {
+	ensureScreen()
+	if drawY < 1 || drawY > height {
+		return
+	}
+	for x := max(drawX, 1); x <= width; x++ {
+		back[drawY-1][x-1] = blankCell
+	}
+}
+
+// paint draws s from drawX, drawY rightwards, cut off at the edge of the
+// screen. Attribute escapes in s change what the rest is drawn with, with
+// attrReset going back to plain text.
+func paint(s string) {
+	ensureScreen()
+	for i := 0; i < len(s); {
+		if strings.HasPrefix(s[i:], "\x1b[") {
+			end := strings.IndexByte(s[i:], 'm')
+			if end < 0 {
+				return
+			}
+			if seq := s[i : i+end+1]; seq == attrReset {
+				drawAttr = ""
+			} else {
+				drawAttr += seq
+			}
+			i += end + 1
+			continue
+		}
+		c, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+		if drawY >= 1 && drawY <= height && drawX >= 1 && drawX <= width {
+			back[drawY-1][drawX-1] = cell{ch: c, attr: drawAttr}
+		}
+		drawX++
+	}
+}
+
+// flush brings the terminal up to date with back. Short runs of unchanged
+// cells are written again rather than jumped over, as that takes fewer
+// bytes than moving the cursor.
+func flush() {
+	if screenSuspended {
+		return
+	}
+	ensureScreen()
+	var b strings.Builder
+	if front == nil {
+		front = makeGrid()
+		b.WriteString(attrReset + cursor.ClearEntireScreen())
+	}
+	attr := ""
+	x, y := 0, 0
+	for row := range back {
+		for col, c := range back[row] {
+			if c == front[row][col] {
+				continue
+			}
+			if y == row+1 && x <= col+1 && col+1-x <= 4 && sameAttr(back[row][x-1:col], attr) {
+				for _, skipped := range back[row][x-1 : col] {
+					b.WriteRune(skipped.ch)
+				}
+			} else if x != col+1 || y != row+1 {
+				b.WriteString(cursor.MoveTo(row+1, col+1))
+			}
+			if c.attr != attr {
+				b.WriteString(attrReset + c.attr)
+				attr = c.attr
+			}
+			b.WriteRune(c.ch)
+			front[row][col] = c
+			x, y = col+2, row+1
+		}
+	}
+	if attr != "" {
+		b.WriteString(attrReset)
+	}
+	if b.Len() == 0 && drawX == shownX && drawY == shownY {
+		return
+	}
+	b.WriteString(cursor.MoveTo(drawY, drawX))
+	shownX, shownY = drawX, drawY
+	io.WriteString(terminal, b.String()) //nolint
+	bytesWritten += b.Len()
+	framesWritten++
+}
+
+func sameAttr(cells []cell, attr string) bool {
+	for _, c := range cells {
+		if c.attr != attr {
+			return false
+		}
+	}
+	return true
+}
+
+// clearTerminal blanks the terminal itself, for leaving the editor
+func clearTerminal() {
+	io.WriteString(terminal, attrReset+cursor.ClearEntireScreen()) //nolint
+}
+
+// suspendScreen hands the terminal over once it is up to date, for a
+// program to write to it directly
+func suspendScreen() {
+	flush()
+	screenSuspended = true
+}
+
+// resumeScreen takes the terminal back, after which the next flush draws
+// it afresh
+func resumeScreen() {
+	screenSuspended = false
+	front = nil
+}
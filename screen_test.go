@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// redrawSession scrolls about the buffer, types on a few lines and
+// searches, as someone editing it might, and quits
+var redrawSession = strings.Repeat("j", 40) + "\x06\x06\x02" + strings.Repeat("k", 20) +
+	"\x04\x15" + "ohello there\x1b" + "Aand some more\x1b" + "xxu" +
+	"/line 7\rnnnN" + "G" + strings.Repeat("k", 10) + "gg" + ":q!\r"
+
+// typeSlowly hands getchar the keys one at a time as it asks for input, so
+// that the screen is flushed between them as it is for keys typed
+func typeSlowly(keys string) {
+	for i := 0; i < len(keys); i++ {
+		<-inputWanted
+		input <- []byte{keys[i]}
+	}
+}
+
+func BenchmarkRedraw(b *testing.B) {
+	lines := make([]string, 1000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d\tof the file, with a few words to fill it out", i)
+	}
+	bytesWritten, framesWritten = 0, 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		startEditor(lines)
+		quit = false
+		go typeSlowly(redrawSession)
+		b.StartTimer()
+		scan()
+	}
+	b.ReportMetric(float64(bytesWritten)/float64(framesWritten), "bytes/frame")
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// patternClasses are the vim character classes written as \x
+var patternClasses = map[byte]string{
+	's': `\s`, 'S': `\S`, 'd': `\d`, 'D': `\D`, 'w': `\w`, 'W': `\W`,
+	'a': `[A-Za-z]`, 'A': `[^A-Za-z]`,
+	'l': `[a-z]`, 'L': `[^a-z]`,
+	'u': `[A-Z]`, 'U': `[^A-Z]`,
+	'x': `[0-9A-Fa-f]`, 'X': `[^0-9A-Fa-f]`,
+	'o': `[0-7]`, 'O': `[^0-7]`,
+	'h': `[A-Za-z_]`, 'H': `[^A-Za-z_]`,
+	'n': `\n`, 't': `\t`, 'r': `\r`, 'e': `\x1b`,
+}
+
+// translatePattern turns a vim pattern into Go regexp syntax. It follows
+// the magic levels \v, \m, \M and \V, and reports \c and \C through
+// ignoreCase, which is -1 when the pattern does not say. Items Go has no
+// equivalent for, such as backreferences, are an error rather than being
+// matched as plain text.
+func translatePattern(pat string) (string, int, error) {
+	var out strings.Builder
+	mode := byte('m')
+	ignoreCase := -1
+
+	// special reports whether c has its regexp meaning without a
+	// backslash in the current mode
+	special := func(c byte) bool {
+		switch mode {
+		case 'v':
+			return strings.IndexByte("()|+?={.*[<>", c) >= 0
+		case 'm':
+			return strings.IndexByte(".*[", c) >= 0
+		default:
+			return false
+		}
+	}
+
+	for i := 0; i < len(pat); i++ {
+		c := pat[i]
+		escaped := false
+		if c == '\\' && i+1 < len(pat) {
+			i++
+			c = pat[i]
+			escaped = true
+			switch c {
+			case 'c':
+				ignoreCase = 1
+				continue
+			case 'C':
+				ignoreCase = 0
+				continue
+			case 'v', 'm', 'M', 'V':
+				mode = c
+				continue
+			}
+			if class, ok := patternClasses[c]; ok {
+				out.WriteString(class)
+				continue
+			}
+			switch {
+			case c >= '1' && c <= '9':
+				return "", 0, errors.New("backreferences are not supported")
+			case isWordChar(c):
+				return "", 0, fmt.Errorf("unsupported pattern item: \\%c", c)
+			}
+		}
+
+		// \%(, \@ and \& take a backslash except in very magic mode
+		if strings.IndexByte("%@&", c) >= 0 && escaped != (mode == 'v') {
+			if c == '%' && i+1 < len(pat) && pat[i+1] == '(' {
+				out.WriteString("(?:")
+				i++
+				continue
+			}
+			item := string(c)
+			if escaped {
+				item = `\` + item
+			}
+			return "", 0, fmt.Errorf("unsupported pattern item: %s", item)
+		}
+
+		// a backslash flips whether the character is special
+		isSpecial := special(c) != escaped
+		if c == '^' || c == '$' {
+			isSpecial = !escaped
+			if mode == 'V' {
+				isSpecial = !escaped && (c == '^' && i == 0 || c == '$' && i == len(pat)-1)
+			}
+		}
+		if !isSpecial || strings.IndexByte("()|+?={.*[<>^$", c) < 0 {
+			out.WriteString(regexp.QuoteMeta(string(c)))
+			continue
+		}
+
+		switch c {
+		case '<', '>':
+			out.WriteString(`\b`)
+		case '=':
+			out.WriteByte('?')
+		case '{':
+			end := strings.IndexByte(pat[i:], '}')
+			if end < 0 {
+				out.WriteString(`\{`)
+				continue
+			}
+			body := strings.TrimSuffix(pat[i+1:i+end], `\`)
+			i += end
+			lazy := strings.HasPrefix(body, "-")
+			body = strings.TrimPrefix(body, "-")
+			switch {
+			case body == "":
+				out.WriteByte('*')
+			case strings.HasPrefix(body, ","):
+				out.WriteString("{0" + body + "}")
+			default:
+				out.WriteString("{" + body + "}")
+			}
+			if lazy {
+				out.WriteByte('?')
+			}
+		case '[':
+			end := closingBracket(pat, i)
+			if end < 0 {
+				out.WriteString(`\[`)
+				continue
+			}
+			out.WriteString(pat[i : end+1])
+			i = end
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String(), ignoreCase, nil
+}
+
+// closingBracket finds the ] ending the collection opened at pat[start]
+func closingBracket(pat string, start int) int {
+	i := start + 1
+	if i < len(pat) && pat[i] == '^' {
+		i++
+	}
+	if i < len(pat) && pat[i] == ']' {
+		i++
+	}
+	for ; i < len(pat); i++ {
+		switch pat[i] {
+		case '\\':
+			i++
+		case ']':
+			return i
+		}
+	}
+	return -1
+}
+
+// hasUpper reports whether pat contains an upper case letter that is not
+// part of a backslash item, for 'smartcase'
+func hasUpper(pat string) bool {
+	for i := 0; i < len(pat); i++ {
+		if pat[i] == '\\' {
+			i++
+			continue
+		}
+		if pat[i] >= 'A' && pat[i] <= 'Z' {
+			return true
+		}
+	}
+	return false
+}
+
+func compilePattern(pat string) (*regexp.Regexp, error) {
+	expr, ignoreCase, err := translatePattern(pat)
+	if err != nil {
+		return nil, err
+	}
+	if ignoreCase < 0 {
+		ignoreCase = 0
+		if optBool("ignorecase") && !(optBool("smartcase") && hasUpper(pat)) {
+			ignoreCase = 1
+		}
+	}
+	if ignoreCase == 1 {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern '%s': %v", pat, err)
+	}
+	return re, nil
+}
+
+// findPattern looks for the next match of re after (or with forward
+// false, before) column x of the nth line, returning its line and the
+// byte range it covers
+func findPattern(re *regexp.Regexp, n int, x int, forward bool) (int, int, int, bool) {
+	l := nthLine(n)
+	if forward {
+		for ; l != nil; l = l.next {
+			for _, m := range re.FindAllStringIndex(l.text, -1) {
+				if m[0] > x {
+					return n, m[0], m[1], true
+				}
+			}
+			x = -1
+			n++
+		}
+		return 0, 0, 0, false
+	}
+
+	for ; l != nil && l != top; l = l.prev {
+		matches := re.FindAllStringIndex(l.text, -1)
+		for i := len(matches) - 1; i >= 0; i-- {
+			if matches[i][0] < x {
+				return n, matches[i][0], matches[i][1], true
+			}
+		}
+		if l.prev != nil {
+			x = len(l.prev.text) + 1
+		}
+		n--
+	}
+	return 0, 0, 0, false
+}
+
+// findWrapped is findPattern continuing from the other end of the buffer
+// when 'wrapscan' is set, reporting whether it had to
+func findWrapped(re *regexp.Regexp, n int, x int, forward bool) (int, int, int, bool, bool) {
+	if mn, start, end, ok := findPattern(re, n, x, forward); ok {
+		return mn, start, end, false, true
+	}
+	if !optBool("wrapscan") {
+		return 0, 0, 0, false, false
+	}
+	if forward {
+		mn, start, end, ok := findPattern(re, 0, -1, true)
+		return mn, start, end, true, ok
+	}
+	last := lineCount() - 1
+	mn, start, end, ok := findPattern(re, last, len(nthLine(last).text)+1, false)
+	return mn, start, end, true, ok
+}
+
+// noHlsearch hides the 'hlsearch' highlight until the next search
+var noHlsearch bool
+
+// incPattern is the pattern being typed while 'incsearch' is on
+var incPattern *regexp.Regexp
+
+// searchCount is the "[3/17]" match indicator shown after a search
+var searchCount string
+
+var hlCache struct {
+	key string
+	re  *regexp.Regexp
+}
+
+// hlPattern is the compiled last search pattern, cached for drawing
+func hlPattern() *regexp.Regexp {
+	key := fmt.Sprintf("%t%t%s", optBool("ignorecase"), optBool("smartcase"), searchTerm)
+	if key != hlCache.key {
+		hlCache.key = key
+		hlCache.re, _ = compilePattern(searchTerm)
+	}
+	return hlCache.re
+}
+
+func searchHighlights(l *line, n int) []span {
+	re := incPattern
+	if re == nil {
+		if !optBool("hlsearch") || noHlsearch || searchTerm == "" {
+			return nil
+		}
+		re = hlPattern()
+		if re == nil {
+			return nil
+		}
+	}
+	var spans []span
+	for _, m := range re.FindAllStringIndex(l.text, -1) {
+		attr := attrSearch
+		if incPattern != nil && n == lineno && m[0] == textX {
+			attr = attrIncSearch
+		}
+		end := m[1]
+		if end == m[0] {
+			end++
+		}
+		spans = append(spans, span{start: m[0], end: end, attr: attr})
+	}
+	return spans
+}
+
+// countMatches returns the number of matches in the buffer and which of
+// them starts at line n, column x
+func countMatches(re *regexp.Regexp, n int, x int) (int, int) {
+	total := 0
+	current := 0
+	i := 0
+	for l := top.next; l != nil; l = l.next {
+		for _, m := range re.FindAllStringIndex(l.text, -1) {
+			total++
+			if i < n || (i == n && m[0] <= x) {
+				current = total
+			}
+		}
+		i++
+	}
+	return current, total
+}
+
+func goToPos(n int, x int) {
+	oldTop := topOfScreen
+	setCursor(n)
+	textX = x
+	if textX > len(currentLine.text)-1 {
+		textX = len(currentLine.text) - 1
+	}
+	if textX < 0 {
+		textX = 0
+	}
+	refresh(oldTop)
+}
+
+// searchOffset is the part of a search after the closing delimiter, as
+// in /foo/e+1: kind is 0 for none, 'l' for lines, or 'e', 's' or 'b'
+type searchOffset struct {
+	kind  byte
+	count int
+}
+
+var lastOffset searchOffset
+var lastSearchForward = true
+
+func parseOffset(s string) (searchOffset, error) {
+	off := searchOffset{}
+	if s == "" {
+		return off, nil
+	}
+	off.kind = 'l'
+	if strings.IndexByte("esb", s[0]) >= 0 {
+		off.kind = s[0]
+		s = s[1:]
+	}
+	switch s {
+	case "":
+		return off, nil
+	case "+":
+		off.count = 1
+	case "-":
+		off.count = -1
+	default:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return off, fmt.Errorf("invalid search offset: %s", s)
+		}
+		off.count = n
+	}
+	return off, nil
+}
+
+// splitSearch separates what was typed after / or ? into the pattern and
+// the rest following the unescaped closing delimiter
+func splitSearch(cmd string, delim byte) (string, string, bool) {
+	for i := 0; i < len(cmd); i++ {
+		switch cmd[i] {
+		case '\\':
+			i++
+		case delim:
+			return cmd[:i], cmd[i+1:], true
+		case '[':
+			if end := closingBracket(cmd, i); end > 0 {
+				i = end
+			}
+		}
+	}
+	return cmd, "", false
+}
+
+// applyOffset turns a match into the cursor position the offset asks for
+func applyOffset(off searchOffset, n int, start int, end int) (int, int) {
+	switch off.kind {
+	case 'l':
+		return n + off.count, 0
+	case 'e':
+		return n, end - 1 + off.count
+	case 's', 'b':
+		return n, start + off.count
+	}
+	return n, start
+}
+
+func searchFor(term string, off searchOffset, forward bool) bool {
+	if currentLine == nil {
+		return false
+	}
+	if term == "" {
+		flash("no previous search pattern")
+		return false
+	}
+	re, err := compilePattern(term)
+	if err != nil {
+		flash(err.Error())
+		return false
+	}
+
+	// skip a match that would leave the cursor where it is, so that n
+	// moves on when the offset puts the cursor away from the match start
+	n, x := lineno, textX
+	wrappedAny := false
+	for tries := 0; tries < 2; tries++ {
+		mn, start, end, wrapped, ok := findWrapped(re, n, x, forward)
+		if !ok {
+			flash(fmt.Sprintf("could not find '%s'", term))
+			return false
+		}
+		wrappedAny = wrappedAny || wrapped
+		n, x = mn, start
+		tn, tx := applyOffset(off, mn, start, end)
+		if tries == 0 && off.kind != 0 && tn == lineno && tx == textX {
+			continue
+		}
+		goToPos(tn, tx)
+		break
+	}
+
+	current, total := countMatches(re, n, x)
+	searchCount = fmt.Sprintf("[%d/%d]", current, total)
+	if optBool("hlsearch") {
+		noHlsearch = false
+		redraw()
+	}
+	if wrappedAny {
+		if forward {
+			flash("search hit BOTTOM, continuing at TOP")
+		} else {
+			flash("search hit TOP, continuing at BOTTOM")
+		}
+	}
+	return true
+}
+
+func executeSearch(term string) {
+	searchFor(term, lastOffset, lastSearchForward)
+}
+
+func executeReverseSearch(term string) {
+	searchFor(term, lastOffset, !lastSearchForward)
+}
+
+// runSearch carries out a search command typed after / or ?, including an
+// offset and further searches chained with ;
+func runSearch(cmd string, forward bool) {
+	delim := byte('/')
+	if !forward {
+		delim = '?'
+	}
+	pattern, rest, _ := splitSearch(cmd, delim)
+	chain := ""
+	if i := strings.IndexByte(rest, ';'); i >= 0 {
+		rest, chain = rest[:i], rest[i+1:]
+	}
+	off, err := parseOffset(rest)
+	if err != nil {
+		flash(err.Error())
+		return
+	}
+	if pattern != "" {
+		searchTerm = pattern
+	}
+	lastOffset = off
+	lastSearchForward = forward
+	if !searchFor(searchTerm, off, forward) {
+		return
+	}
+	if chain != "" && (chain[0] == '/' || chain[0] == '?') {
+		runSearch(chain[1:], chain[0] == '/')
+	}
+}
+
+// readSearchTerm collects a pattern on the message line, returning false
+// if it was abandoned
+func readSearchTerm(delim byte) (string, bool) {
+	origN, origX, origTop, origPos := lineno, textX, topOfScreen, topPos
+	restoreCursor := func() {
+		topOfScreen, topPos = origTop, origPos
+		setCursor(origN)
+		textX = origX
+		keepCursorVisible()
+		setXPos()
+	}
+	// incremental shows where term would land while it is typed
+	incremental := func(term string) {
+		if !optBool("incsearch") {
+			return
+		}
+		restoreCursor()
+		incPattern = nil
+		pattern, _, _ := splitSearch(term, delim)
+		if re, err := compilePattern(pattern); err == nil && pattern != "" {
+			incPattern = re
+			n, x, _, _, ok := findWrapped(re, origN, origX, delim == '/')
+			if ok {
+				setCursor(n)
+				textX = x
+				keepCursorVisible()
+			}
+		}
+		redraw()
+	}
+	defer func() {
+		if incPattern != nil {
+			incPattern = nil
+			restoreCursor()
+			redraw()
+		}
+	}()
+
+	term, ok := readLine(string(delim), &searchHistory, "", incremental)
+	clearBanner()
+	return term, ok
+}
+
+// search reads and runs a / search, or a ? search with delim '?'
+func search(delim byte) {
+	cmd, ok := readSearchTerm(delim)
+	if !ok {
+		return
+	}
+	runSearch(cmd, delim == '/')
+}
+
+// starSearch implements * and #, searching for the word under the cursor
+// or the next one on the line
+func starSearch(forward bool) {
+	if currentLine == nil {
+		return
+	}
+	text := currentLine.text
+	start := textX
+	for start < len(text) && !isWordChar(text[start]) {
+		start++
+	}
+	if start >= len(text) {
+		flash("no identifier under cursor")
+		return
+	}
+	for start > 0 && isWordChar(text[start-1]) {
+		start--
+	}
+	end := start
+	for end < len(text) && isWordChar(text[end]) {
+		end++
+	}
+	searchTerm = `\<` + text[start:end] + `\>`
+	lastOffset = searchOffset{}
+	lastSearchForward = forward
+	// start from the beginning of the word so # skips the word itself
+	textX = start
+	searchFor(searchTerm, lastOffset, forward)
+}
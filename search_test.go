@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTranslatePattern(t *testing.T) {
+	tests := []struct {
+		pat        string
+		want       string
+		ignoreCase int
+		err        string
+	}{
+		{pat: `foo.*bar`, want: `foo.*bar`, ignoreCase: -1},
+		{pat: `\<the\>`, want: `\bthe\b`, ignoreCase: -1},
+		{pat: `\v<the>`, want: `\bthe\b`, ignoreCase: -1},
+		{pat: `\v(a|b)+`, want: `(a|b)+`, ignoreCase: -1},
+		{pat: `(a|b)+`, want: `\(a\|b\)\+`, ignoreCase: -1},
+		{pat: `\(a\|b\)\+`, want: `(a|b)+`, ignoreCase: -1},
+		{pat: `a\{2,3}`, want: `a{2,3}`, ignoreCase: -1},
+		{pat: `a\{,3}`, want: `a{0,3}`, ignoreCase: -1},
+		{pat: `a\{}`, want: `a*`, ignoreCase: -1},
+		{pat: `a\{-}`, want: `a*?`, ignoreCase: -1},
+		{pat: `a\{-1,}`, want: `a{1,}?`, ignoreCase: -1},
+		{pat: `\v a{2}`, want: ` a{2}`, ignoreCase: -1},
+		{pat: `\%(ab\)*`, want: `(?:ab)*`, ignoreCase: -1},
+		{pat: `\v%(ab)*`, want: `(?:ab)*`, ignoreCase: -1},
+		{pat: `50%`, want: `50%`, ignoreCase: -1},
+		{pat: `\V.*`, want: `\.\*`, ignoreCase: -1},
+		{pat: `\d\+\s`, want: `\d+\s`, ignoreCase: -1},
+		{pat: `\cfoo`, want: `foo`, ignoreCase: 1},
+		{pat: `foo\C`, want: `foo`, ignoreCase: 0},
+		{pat: `a\/b`, want: `a/b`, ignoreCase: -1},
+		{pat: `\(a\)\1`, err: "backreferences are not supported"},
+		{pat: `\v(a)\1`, err: "backreferences are not supported"},
+		{pat: `\zsfoo`, err: `unsupported pattern item: \z`},
+		{pat: `\_s`, err: `unsupported pattern item: \_`},
+		{pat: `foo\@=`, err: `unsupported pattern item: \@`},
+		{pat: `\%V`, err: `unsupported pattern item: \%`},
+		{pat: `\vfoo@!`, err: `unsupported pattern item: @`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pat, func(t *testing.T) {
+			got, ignoreCase, err := translatePattern(tt.pat)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got %q and error %v, want error %q", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got != tt.want || ignoreCase != tt.ignoreCase {
+				t.Errorf("got %q, %d, want %q, %d", got, ignoreCase, tt.want, tt.ignoreCase)
+			}
+		})
+	}
+}
+
+func TestSearchCountInStatusLine(t *testing.T) {
+	startEditor([]string{"one", "two", "one more", "three"})
+	typeKeys("/one\r")
+	drawStatusLines()
+	if got := screenRowText(winRow + winRows); !strings.Contains(got, "[2/2]") {
+		t.Errorf("status line %q has no [2/2] match count", got)
+	}
+	flash("a message")
+	drawStatusLines()
+	if got := screenRowText(winRow + winRows); !strings.Contains(got, "[2/2]") {
+		t.Errorf("the match count went from the status line %q with a message", got)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// lastShellCommand is what a ! in a shell command stands for
+var lastShellCommand string
+var haveShellCommand bool
+
+func shellName() string {
+	if sh := os.Getenv("SHELL"); sh != "" {
+		return sh
+	}
+	return "sh"
+}
+
+// expandShellCommand puts the file name in place of % and the previous
+// shell command in place of !, either of which a backslash makes literal
+func expandShellCommand(cmd string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case c == '\\' && i+1 < len(cmd) && (cmd[i+1] == '%' || cmd[i+1] == '!'):
+			i++
+			b.WriteByte(cmd[i])
+		case c == '%':
+			if filename == "" {
+				return "", errors.New("no file name to substitute for '%'")
+			}
+			b.WriteString(filename)
+		case c == '!':
+			if !haveShellCommand {
+				return "", errors.New("no previous command")
+			}
+			b.WriteString(lastShellCommand)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	lastShellCommand = b.String()
+	haveShellCommand = true
+	return lastShellCommand, nil
+}
+
+// leaveRaw puts the terminal back the way it was for a program to use
+func leaveRaw() {
+	fmt.Print(focusReportingOff)
+	if cookedOut != nil {
+		term.Restore(int(os.Stdout.Fd()), cookedOut) //nolint
+	}
+	if cookedIn != nil {
+		term.Restore(int(os.Stdin.Fd()), cookedIn) //nolint
+	}
+}
+
+func enterRaw() {
+	if cookedIn != nil {
+		term.MakeRaw(int(os.Stdin.Fd())) //nolint
+	}
+	if cookedOut != nil {
+		term.MakeRaw(int(os.Stdout.Fd())) //nolint
+	}
+	fmt.Print(focusReportingOn)
+}
+
+// shellError describes how a command failed, if it did
+func shellError(err error, stderr []byte) error {
+	if err == nil {
+		return nil
+	}
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) {
+		return fmt.Errorf("cannot run shell: %v", err)
+	}
+	msg := fmt.Sprintf("shell returned %d", exit.ExitCode())
+	if first, _, _ := strings.Cut(strings.TrimSpace(string(stderr)), "\n"); first != "" {
+		msg += ": " + first
+	}
+	return errors.New(msg)
+}
+
+// runInTerminal runs cmd on the terminal, with input if it is not nil as
+// its standard input, and waits for a key before the screen is redrawn
+func runInTerminal(cmd string, input []byte) error {
+	move(1, height)
+	suspendScreen()
+	fmt.Print("\r\n")
+	leaveRaw()
+	c := exec.Command(shellName(), "-c", cmd)
+	c.Stdin = os.Stdin
+	if input != nil {
+		c.Stdin = bytes.NewReader(input)
+	}
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	err := shellError(c.Run(), nil)
+	enterRaw()
+	if err != nil {
+		fmt.Print("\r\n" + err.Error() + "\r\n")
+	}
+	fmt.Print(hitEnterPrompt)
+	getchar()
+	resumeScreen()
+	redraw()
+	restore()
+	return err
+}
+
+// captureShell runs cmd with input as its standard input, returning what
+// it wrote to its standard output as lines
+func captureShell(cmd string, input []byte) ([]string, error) {
+	c := exec.Command(shellName(), "-c", cmd)
+	c.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	err := shellError(c.Run(), stderr.Bytes())
+	out := strings.TrimSuffix(stdout.String(), "\n")
+	if stdout.Len() == 0 {
+		return nil, err
+	}
+	return strings.Split(out, "\n"), err
+}
+
+// linesInput is lines first to last as input for a command
+func linesInput(first int, last int) []byte {
+	return []byte(strings.Join(lineTexts(first, last), "\n") + "\n")
+}
+
+// exShell is :!cmd, or with a range :{range}!cmd, which filters the lines
+// through cmd
+func exShell(ex *exArgs) error {
+	arg := ex.arg
+	if ex.bang {
+		arg = "!" + arg
+	}
+	cmd, err := expandShellCommand(arg)
+	if err != nil {
+		return err
+	}
+	if ex.addrs == 0 {
+		return runInTerminal(cmd, nil)
+	}
+	return filterLines(ex.line1, ex.line2, cmd)
+}
+
+// filterLines replaces lines first to last with what cmd makes of them,
+// leaving them alone if it fails
+func filterLines(first int, last int, cmd string) error {
+	out, err := captureShell(cmd, linesInput(first, last))
+	if err != nil {
+		return err
+	}
+	saveUndo()
+	insertLinesAfter(nthLine(last), out)
+	removeLines(first, last)
+	finishLines(first)
+	if count := last - first + 1; count > 2 && !globalBusy {
+		report(fmt.Sprintf("%d lines filtered", count))
+	}
+	return nil
+}
+
+// readShell is :r !cmd, putting the output of cmd below line n
+func readShell(n int, arg string) error {
+	cmd, err := expandShellCommand(arg)
+	if err != nil {
+		return err
+	}
+	out, err := captureShell(cmd, nil)
+	if len(out) > 0 {
+		saveUndo()
+		insertLinesAfter(nthLine(n), out)
+		finishLines(n + 1)
+	}
+	return err
+}
+
+// writeShell is :w !cmd, giving lines first to last to cmd as input
+func writeShell(first int, last int, arg string) error {
+	cmd, err := expandShellCommand(arg)
+	if err != nil {
+		return err
+	}
+	return runInTerminal(cmd, linesInput(first, last))
+}
+
+// bangHandle is the ! operator: it moves over the lines the following
+// motion covers and opens the command line with a range for them and a
+// !, ready for the filter command
+func bangHandle() {
+	first, last, ok := motionLines()
+	if !ok {
+		return
+	}
+	oldTop := topOfScreen
+	setCursor(first)
+	refresh(oldTop)
+	rangeText := "."
+	if last > first {
+		rangeText = fmt.Sprintf(".,.+%d", last-first)
+	}
+	commandWith(rangeText + "!")
+}
+
+// motionLines reads a motion for a linewise operator, returning the
+// lines it covers in order. The operator's own key again stands for the
+// current line, and ip and ap for the paragraph the cursor is in.
+func motionLines() (int, int, bool) {
+	c := normalKey()
+	switch c {
+	case ESCAPE_CODE:
+		return 0, 0, false
+	case '!':
+		return lineno, lineno, true
+	case 'i', 'a':
+		if obj := getchar(); obj != 'p' {
+			flash(fmt.Sprintf("unknown text object: '%c%c'", c, obj))
+			return 0, 0, false
+		}
+		first, last := paragraphLines(c == 'a')
+		return first, last, true
+	}
+
+	n, x, oldTop, oldPos := lineno, textX, topOfScreen, topPos
+	if !motion(c) {
+		flash(fmt.Sprintf("unknown motion: '%c'", c))
+		return 0, 0, false
+	}
+	moved := lineno
+	scrolled := topOfScreen != oldTop
+	textX = x
+	setCursor(n)
+	topOfScreen, topPos = oldTop, oldPos
+	if scrolled {
+		redraw()
+	}
+	if moved < n {
+		return moved, n, true
+	}
+	return n, moved, true
+}
+
+func isBlank(text string) bool {
+	return strings.TrimLeft(text, " \t") == ""
+}
+
+// paragraphLines finds the paragraph around the cursor: the run of
+// non-blank lines, or of blank lines if the cursor is on one. With around
+// set it takes in the blank lines after it too, or if there are none the
+// ones before it.
+func paragraphLines(around bool) (int, int) {
+	blank := isBlank(currentLine.text)
+	first, last := lineno, lineno
+	for l := currentLine.prev; l != top && isBlank(l.text) == blank; l = l.prev {
+		first--
+	}
+	l := currentLine.next
+	for ; l != nil && isBlank(l.text) == blank; l = l.next {
+		last++
+	}
+	if !around {
+		return first, last
+	}
+	if l != nil {
+		for ; l != nil && isBlank(l.text) != blank; l = l.next {
+			last++
+		}
+		return first, last
+	}
+	for l := nthLine(first).prev; l != top && isBlank(l.text) != blank; l = l.prev {
+		first--
+	}
+	return first, last
+}
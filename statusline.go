@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// inserting is set while insert mode runs, for the mode shown in the
+// status line
+var inserting bool
+
+// modeName is the mode the editor is in, as the status line shows it
+func modeName() string {
+	switch {
+	case visualMode == 'V':
+		return "V-LINE"
+	case visualMode == CTRL_V_CODE:
+		return "V-BLOCK"
+	case visualMode != 0:
+		return "VISUAL"
+	case inserting:
+		return "INSERT"
+	}
+	return "NORMAL"
+}
+
+var fileTypes = map[string]string{
+	".c":    "c",
+	".h":    "c",
+	".cc":   "cpp",
+	".cpp":  "cpp",
+	".css":  "css",
+	".go":   "go",
+	".html": "html",
+	".java": "java",
+	".js":   "javascript",
+	".json": "json",
+	".md":   "markdown",
+	".py":   "python",
+	".rs":   "rust",
+	".sh":   "sh",
+	".ts":   "typescript",
+	".txt":  "text",
+	".yaml": "yaml",
+	".yml":  "yaml",
+}
+
+// fileType guesses what kind of file name is from its name
+func fileType(name string) string {
+	switch filepath.Base(name) {
+	case "Makefile", "makefile", "GNUmakefile":
+		return "make"
+	case "go.mod":
+		return "gomod"
+	}
+	return fileTypes[strings.ToLower(filepath.Ext(name))]
+}
+
+// statusItem expands the statusline item c, or the expression inside %{}
+// when c is '{'
+func statusItem(c byte, expr string) string {
+	switch c {
+	case 'f':
+		return bufferName(curBuf)
+	case 'F':
+		if filename == "" {
+			return "[No Name]"
+		}
+		if abs, err := filepath.Abs(filename); err == nil {
+			return abs
+		}
+		return filename
+	case 't':
+		if filename == "" {
+			return "[No Name]"
+		}
+		return filepath.Base(filename)
+	case 'm':
+		if isModified() {
+			return "[+]"
+		}
+	case 'r':
+		if readOnly {
+			return "[RO]"
+		}
+	case 'y':
+		if ft := fileType(filename); ft != "" {
+			return "[" + ft + "]"
+		}
+	case 'n':
+		return strconv.Itoa(curBuf.number)
+	case 'l':
+		return strconv.Itoa(lineno + 1)
+	// L, p and P use the line count and the index of the top of the
+	// screen kept as lines change, so that redraws do not walk the buffer
+	case 'L':
+		return strconv.Itoa(numLines)
+	case 'c':
+		return strconv.Itoa(textX + 1)
+	case 'v':
+		if currentLine == nil {
+			return "1"
+		}
+		return strconv.Itoa(virtCol(currentLine.text, textX) + 1)
+	case 'p':
+		return strconv.Itoa((lineno + 1) * 100 / numLines)
+	case 'P':
+		above, below := topIndex()+1, numLines-1-lastVisible()
+		switch {
+		case above == 0 && below == 0:
+			return "All"
+		case above == 0:
+			return "Top"
+		case below == 0:
+			return "Bot"
+		}
+		return fmt.Sprintf("%d%%", above*100/(above+below))
+	case '{':
+		switch expr {
+		case "mode()":
+			return modeName()
+		case "searchcount()":
+			if !statusActive {
+				return ""
+			}
+			return searchCount
+		case "&fileencoding", "&fenc":
+			return fileEncoding
+		case "&fileformat", "&ff":
+			return fileFormat
+		case "&filetype", "&ft":
+			return fileType(filename)
+		}
+	}
+	return ""
+}
+
+// formatStatus builds the status line of the current window from the
+// 'statusline' format, which is text with %items much like vim's: %f, %F
+// and %t for the file name, %m, %r and %y for the modified, read-only and
+// file type flags, %n for the buffer number, %l, %L, %c and %v for the
+// line, line count and column, %p and %P for how far through the file
+// the cursor and the window are, %{mode()}, %{searchcount()} for the
+// "[3/17]" count of matches after a search, %{&fenc}, %{&ff} and %{&ft},
+// and %= to push what follows to the right. An item may start with a
+// minimum width, left aligned with -, and a maximum width after a dot.
+func formatStatus(format string, cols int) string {
+	var left, right strings.Builder
+	out := &left
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' || i+1 == len(format) {
+			out.WriteByte(c)
+			continue
+		}
+		i++
+		leftAlign := format[i] == '-'
+		if leftAlign {
+			i++
+		}
+		minWidth, maxWidth := 0, -1
+		for i < len(format) && isDigit(format[i]) {
+			minWidth = minWidth*10 + int(format[i]-'0')
+			i++
+		}
+		if i < len(format) && format[i] == '.' {
+			maxWidth = 0
+			for i++; i < len(format) && isDigit(format[i]); i++ {
+				maxWidth = maxWidth*10 + int(format[i]-'0')
+			}
+		}
+		if i == len(format) {
+			break
+		}
+		var item string
+		switch c = format[i]; c {
+		case '%':
+			item = "%"
+		case '=':
+			out = &right
+			continue
+		case '{':
+			end := strings.IndexByte(format[i:], '}')
+			if end < 0 {
+				end = len(format) - i
+			}
+			item = statusItem('{', format[i+1:i+end])
+			i += end
+		default:
+			item = statusItem(c, "")
+		}
+		if maxWidth >= 0 && len(item) > maxWidth {
+			item = item[:maxWidth]
+		}
+		if pad := minWidth - len(item); pad > 0 {
+			if leftAlign {
+				item += strings.Repeat(" ", pad)
+			} else {
+				item = strings.Repeat(" ", pad) + item
+			}
+		}
+		out.WriteString(item)
+	}
+	text := left.String()
+	if pad := cols - len(text) - right.Len(); pad > 0 {
+		text += strings.Repeat(" ", pad)
+	}
+	text += right.String()
+	if len(text) > cols {
+		text = text[:cols]
+	}
+	return text + strings.Repeat(" ", cols-len(text))
+}
+
+// drawStatusLines draws the status line under each window
+func drawStatusLines() {
+	active := curWin
+	for _, w := range windowList() {
+		withWindow(w, func() {
+			drawStatus(w == active)
+		})
+	}
+	restore()
+}
+
+// statusActive is set while the status line of the window being edited
+// is drawn
+var statusActive bool
+
+// drawStatus draws the status line of the current window, highlighted
+// more strongly when it is the window being edited
+func drawStatus(active bool) {
+	attr := attrStatusNC
+	if active {
+		attr = attrStatus
+	}
+	statusActive = active
+	move(winCol, winRow+winRows)
+	paint(attr + formatStatus(optString("statusline"), winCols) + attrReset)
+}
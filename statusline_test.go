@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestStatusPosition(t *testing.T) {
+	lines := make([]string, 100000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d", i)
+	}
+	startEditor(lines)
+	tests := []struct {
+		keys    string
+		L, p, P string
+	}{
+		{"", "100000", "0", "Top"},
+		{":50000\r", "100000", "50", "49%"},
+		{"jjj\x04k", "100000", "50", "50%"},
+		{"G", "100000", "100", "Bot"},
+		{"dd", "99999", "100", "Bot"},
+		{":1,10d\r", "99989", "0", "Top"},
+	}
+	for _, tt := range tests {
+		typeKeys(tt.keys)
+		// the position items must come from the kept index, not a walk
+		if !topKnown() {
+			t.Errorf("after %q the index of the top of the screen is not known", tt.keys)
+		}
+		got := [3]string{statusItem('L', ""), statusItem('p', ""), statusItem('P', "")}
+		if want := [3]string{tt.L, tt.p, tt.P}; got != want {
+			t.Errorf("after %q got L p P %v, want %v", tt.keys, got, want)
+		}
+	}
+}
+
+func BenchmarkStatusPosition(b *testing.B) {
+	lines := make([]string, 400000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d", i)
+	}
+	startEditor(lines)
+	typeKeys(":200000\r")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		statusItem('L', "")
+		statusItem('p', "")
+		statusItem('P', "")
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// substitution is what :s was last asked to do, for ~, :& and g&
+type substitution struct {
+	pattern     string
+	replacement string
+	flags       string
+}
+
+var lastSub substitution
+var haveLastSub bool
+
+// subMatch is the match :s is asking about when confirming
+var subMatch struct {
+	l     *line
+	start int
+	end   int
+}
+
+func substituteHighlights(l *line) []span {
+	if subMatch.l != l || l == nil {
+		return nil
+	}
+	return []span{{subMatch.start, subMatch.end, attrIncSearch}}
+}
+
+func isSubDelimiter(c byte) bool {
+	return c != ' ' && c != '\\' && c != '"' && c != '|' && !isLetter(c) && !isDigit(c)
+}
+
+// splitReplacement separates the replacement from the flags following its
+// closing delimiter, putting the previous replacement in place of ~
+func splitReplacement(s string, delim byte) (string, string) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			i++
+			if s[i] == delim {
+				b.WriteByte(delim)
+			} else {
+				b.WriteByte('\\')
+				b.WriteByte(s[i])
+			}
+		case c == '~':
+			b.WriteString(lastSub.replacement)
+		case c == delim:
+			return b.String(), s[i+1:]
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), ""
+}
+
+// parseSubstitute reads the argument of :s or :&, returning what to do,
+// the count and the commands following a |
+func parseSubstitute(ex *exArgs) (substitution, int, error) {
+	arg := ex.arg
+	sub := lastSub
+	if ex.cmd.name == "substitute" && arg != "" && isSubDelimiter(arg[0]) {
+		delim := arg[0]
+		pattern, rest, closed := splitSearch(arg[1:], delim)
+		replacement := ""
+		if closed {
+			replacement, rest = splitReplacement(rest, delim)
+		}
+		if pattern == "" {
+			pattern = searchTerm
+		}
+		sub = substitution{pattern: pattern, replacement: replacement}
+		arg = rest
+	} else if !haveLastSub {
+		return sub, 0, errors.New("no previous substitute regular expression")
+	} else {
+		sub.flags = ""
+	}
+
+	if strings.HasPrefix(arg, "&") {
+		sub.flags = lastSub.flags
+		arg = arg[1:]
+	}
+	i := 0
+	for i < len(arg) && strings.IndexByte("cegiIn", arg[i]) >= 0 {
+		i++
+	}
+	sub.flags += arg[:i]
+
+	p := &exParser{text: arg, pos: i}
+	p.skipSpace()
+	count := 0
+	if isDigit(p.peek()) {
+		count = p.number()
+		if count == 0 {
+			return sub, 0, errors.New("positive count required")
+		}
+	}
+	p.skipSpace()
+	switch p.peek() {
+	case 0:
+	case '|':
+		ex.next = p.text[p.pos+1:]
+	default:
+		return sub, 0, fmt.Errorf("trailing characters: %s", p.text[p.pos:])
+	}
+	return sub, count, nil
+}
+
+func exSubstitute(ex *exArgs) error {
+	sub, count, err := parseSubstitute(ex)
+	if err != nil {
+		return err
+	}
+	if sub.pattern == "" {
+		return errors.New("no previous regular expression")
+	}
+	lastSub = sub
+	haveLastSub = true
+	searchTerm = sub.pattern
+
+	pattern := sub.pattern
+	if strings.ContainsRune(sub.flags, 'i') {
+		pattern = `\c` + pattern
+	} else if strings.ContainsRune(sub.flags, 'I') {
+		pattern = `\C` + pattern
+	}
+	re, err := compilePattern(pattern)
+	if err != nil {
+		return err
+	}
+
+	line1, line2 := ex.line1, ex.line2
+	if count > 0 {
+		line1 = line2
+		line2 = min(line2+count-1, lineCount()-1)
+	}
+	return substitute(sub, re, line1, line2)
+}
+
+// substitute carries out sub on lines line1 to line2
+func substitute(sub substitution, re *regexp.Regexp, line1 int, line2 int) error {
+	flag := func(c rune) bool {
+		return strings.ContainsRune(sub.flags, c)
+	}
+	global, countOnly := flag('g'), flag('n')
+	confirm := flag('c') && !countOnly
+	if !countOnly {
+		saveUndo()
+	}
+
+	subs, lines, lastLine := 0, 0, -1
+	var lastL *line
+	stop, all := false, false
+	l := nthLine(line1)
+	for n := line1; n <= line2 && l != nil && !stop; n++ {
+		text := l.text
+		limit := 1
+		if global {
+			limit = -1
+		}
+		matches := re.FindAllStringSubmatchIndex(text, limit)
+		if len(matches) == 0 {
+			l = l.next
+			continue
+		}
+		if countOnly {
+			subs += len(matches)
+			lines++
+			l = l.next
+			continue
+		}
+
+		var out strings.Builder
+		prev := 0
+		changed := false
+		for _, m := range matches {
+			replace := true
+			if confirm && !all {
+				answer := confirmSubstitute(l, n, out.String(), text[prev:], m[0]-prev, m[1]-prev, sub.replacement)
+				switch answer {
+				case 'n':
+					replace = false
+				case 'a':
+					all = true
+				case 'l', 'q':
+					stop = true
+					replace = answer == 'l'
+				}
+			}
+			if replace {
+				out.WriteString(text[prev:m[0]])
+				out.WriteString(expandReplacement(sub.replacement, text, m))
+				prev = m[1]
+				subs++
+				changed = true
+			}
+			if stop {
+				break
+			}
+		}
+		out.WriteString(text[prev:])
+		if changed {
+			lines++
+			parts := strings.Split(out.String(), "\n")
+			l.text = parts[0]
+			if len(parts) > 1 {
+				l = insertLinesAfter(l, parts[1:])
+				n += len(parts) - 1
+				line2 += len(parts) - 1
+			}
+			lastLine, lastL = n, l
+		}
+		l = l.next
+	}
+	subMatch.l = nil
+
+	if globalBusy {
+		subTotals.subs += subs
+		subTotals.lines += lines
+	}
+	if subs == 0 {
+		if !countOnly {
+			dropUndo()
+		}
+		if confirm && stop || flag('e') || globalBusy {
+			redraw()
+			return nil
+		}
+		return fmt.Errorf("pattern not found: %s", sub.pattern)
+	}
+	if countOnly {
+		report(plural(subs, "match") + " on " + plural(lines, "line"))
+		return nil
+	}
+	if lastL != nil {
+		lineno, currentLine = lastLine, lastL
+	}
+	// :g draws the screen once it has run on every line
+	if !globalBusy {
+		redraw()
+		refresh(nil)
+	}
+	firstNonBlank()
+	if subs > 1 && !globalBusy {
+		report(plural(subs, "substitution") + " on " + plural(lines, "line"))
+	}
+	return nil
+}
+
+// plural is n followed by word, made plural unless n is 1
+func plural(n int, word string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, word)
+	}
+	if strings.HasSuffix(word, "ch") {
+		return fmt.Sprintf("%d %ses", n, word)
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
+
+// confirmSubstitute shows the line with the substitutions made so far and
+// asks whether to replace the match from start to end of rest, returning
+// one of y, n, a, l and q
+func confirmSubstitute(l *line, n int, done string, rest string, start int, end int, replacement string) byte {
+	// only the last line of what has been replaced is still on this line
+	done = done[strings.LastIndexByte(done, '\n')+1:]
+	original := l.text
+	l.text = done + rest
+	subMatch.l = l
+	subMatch.start = len(done) + start
+	subMatch.end = len(done) + end
+	goToPos(n, subMatch.start)
+	redraw()
+	defer func() {
+		l.text = original
+	}()
+
+	for {
+		clearBanner()
+		flash(fmt.Sprintf("replace with %s (y/n/a/q/l)?", replacement))
+		switch c := getchar(); c {
+		case 'y', 'n', 'a', 'l', 'q':
+			return c
+		case ESCAPE_CODE, CTRL_C_CODE:
+			return 'q'
+		}
+	}
+}
+
+// expandReplacement builds the text to put in place of match m of text,
+// following & and \0 to \9, \r for a line break, \n for a NUL as in vim,
+// \t, and the case changes \u, \l, \U, \L, \E and \e
+func expandReplacement(replacement string, text string, m []int) string {
+	var b strings.Builder
+	var once, mode byte
+	emit := func(s string) {
+		for _, r := range s {
+			switch {
+			case once == 'u':
+				r = unicode.ToUpper(r)
+			case once == 'l':
+				r = unicode.ToLower(r)
+			case mode == 'U':
+				r = unicode.ToUpper(r)
+			case mode == 'L':
+				r = unicode.ToLower(r)
+			}
+			once = 0
+			b.WriteRune(r)
+		}
+	}
+	group := func(i int) string {
+		if 2*i+1 >= len(m) || m[2*i] < 0 {
+			return ""
+		}
+		return text[m[2*i]:m[2*i+1]]
+	}
+
+	for i := 0; i < len(replacement); i++ {
+		c := replacement[i]
+		if c == '&' {
+			emit(group(0))
+			continue
+		}
+		if c != '\\' || i+1 == len(replacement) {
+			emit(string(c))
+			continue
+		}
+		i++
+		switch c = replacement[i]; c {
+		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+			emit(group(int(c - '0')))
+		case 'r':
+			b.WriteByte('\n')
+		case 'n':
+			b.WriteByte(0)
+		case 't':
+			emit("\t")
+		case 'u', 'l':
+			once = c
+		case 'U', 'L':
+			mode = c
+		case 'E', 'e':
+			mode = 0
+		default:
+			emit(string(c))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSubstitute(t *testing.T) {
+	lastSub = substitution{pattern: "old", replacement: "prev", flags: "g"}
+	haveLastSub = true
+	defer func() { lastSub, haveLastSub = substitution{}, false }()
+	searchTerm = "searched"
+
+	tests := []struct {
+		cmd   string
+		arg   string
+		sub   substitution
+		count int
+		next  string
+		err   string
+	}{
+		{cmd: "s", arg: "/a/b/", sub: substitution{pattern: "a", replacement: "b"}},
+		{cmd: "s", arg: "/a/b", sub: substitution{pattern: "a", replacement: "b"}},
+		{cmd: "s", arg: "/a", sub: substitution{pattern: "a"}},
+		{cmd: "s", arg: "#a/b#c/d#g", sub: substitution{pattern: "a/b", replacement: "c/d", flags: "g"}},
+		{cmd: "s", arg: `/a\/b/c\/d/`, sub: substitution{pattern: `a\/b`, replacement: "c/d"}},
+		{cmd: "s", arg: "/a/b/gcin", sub: substitution{pattern: "a", replacement: "b", flags: "gcin"}},
+		{cmd: "s", arg: "/a/b/I 3", sub: substitution{pattern: "a", replacement: "b", flags: "I"}, count: 3},
+		{cmd: "s", arg: "/a/b/&", sub: substitution{pattern: "a", replacement: "b", flags: "g"}},
+		{cmd: "s", arg: "/a/b/&c", sub: substitution{pattern: "a", replacement: "b", flags: "gc"}},
+		{cmd: "s", arg: "/a/x~y/", sub: substitution{pattern: "a", replacement: "xprevy"}},
+		{cmd: "s", arg: `/a/x\~y/`, sub: substitution{pattern: "a", replacement: `x\~y`}},
+		{cmd: "s", arg: "//b/", sub: substitution{pattern: "searched", replacement: "b"}},
+		{cmd: "s", arg: "/a/b/ | p", sub: substitution{pattern: "a", replacement: "b"}, next: " p"},
+		{cmd: "s", arg: "", sub: substitution{pattern: "old", replacement: "prev"}},
+		{cmd: "s", arg: "g", sub: substitution{pattern: "old", replacement: "prev", flags: "g"}},
+		{cmd: "&", arg: "&", sub: substitution{pattern: "old", replacement: "prev", flags: "g"}},
+		{cmd: "s", arg: "/a/b/ 0", err: "positive count required"},
+		{cmd: "s", arg: "/a/b/x", err: "trailing characters: x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cmd+tt.arg, func(t *testing.T) {
+			ex := &exArgs{cmd: lookupCommand(tt.cmd), arg: tt.arg}
+			sub, count, err := parseSubstitute(ex)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if sub != tt.sub || count != tt.count || ex.next != tt.next {
+				t.Errorf("got %+v, %d, next %q, want %+v, %d, next %q", sub, count, ex.next, tt.sub, tt.count, tt.next)
+			}
+		})
+	}
+}
+
+func TestExpandReplacement(t *testing.T) {
+	tests := []struct {
+		replacement string
+		want        string
+	}{
+		{`[&]`, "[foo bar]"},
+		{`\0`, "foo bar"},
+		{`\2 \1`, "bar foo"},
+		{`\3`, ""},
+		{`a\rb`, "a\nb"},
+		{`a\nb`, "a\x00b"},
+		{`a\tb`, "a\tb"},
+		{`\u\1`, "Foo"},
+		{`\U\1 \E\2`, "FOO bar"},
+		{`\U\1 \e\2`, "FOO bar"},
+		{`\L\U\l&`, "fOO BAR"},
+		{`\u\L&`, "Foo bar"},
+		{`\&\\`, `&\`},
+		{`x\`, `x\`},
+	}
+	text := "say foo bar"
+	m := []int{4, 11, 4, 7, 8, 11}
+	for _, tt := range tests {
+		t.Run(tt.replacement, func(t *testing.T) {
+			if got := expandReplacement(tt.replacement, text, m); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubstituteLineBreak(t *testing.T) {
+	startEditor([]string{"axb"})
+	typeKeys(":s/x/\\r/\r")
+	if got := strings.Join(lineTexts(0, lineCount()-1), "|"); got != "a|b" {
+		t.Errorf(`\r gave %q, want a line break`, got)
+	}
+	startEditor([]string{"axb"})
+	typeKeys(":s/x/\\n/\r")
+	if got := strings.Join(lineTexts(0, lineCount()-1), "|"); got != "a\x00b" {
+		t.Errorf(`\n gave %q, want a NUL`, got)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// tabpage is a layout of windows filling the screen. The current tab page
+// keeps its layout in rootFrame and curWin while it is current.
+type tabpage struct {
+	root *frame
+	win  *window
+}
+
+var tabs []*tabpage
+var curTab *tabpage
+
+// showTabLine reports whether the top row holds the tab line, which it
+// does once there is more than one tab page
+func showTabLine() bool {
+	return len(tabs) > 1
+}
+
+func tabIndex(t *tabpage) int {
+	for i, other := range tabs {
+		if other == t {
+			return i
+		}
+	}
+	return -1
+}
+
+// tabRoot is the layout of t, which for the current tab page is not
+// stashed away
+func tabRoot(t *tabpage) *frame {
+	if t == curTab {
+		return rootFrame
+	}
+	return t.root
+}
+
+func tabWindow(t *tabpage) *window {
+	if t == curTab {
+		return curWin
+	}
+	return t.win
+}
+
+// allWindows is the windows of every tab page
+func allWindows() []*window {
+	var list []*window
+	for _, t := range tabs {
+		list = append(list, windowsIn(tabRoot(t))...)
+	}
+	return list
+}
+
+// addTab makes a tab page with a single window showing b after the
+// current one, without going to it
+func addTab(b *buffer) *tabpage {
+	w := newWindow(b)
+	t := &tabpage{root: w.frame, win: w}
+	i := tabIndex(curTab) + 1
+	tabs = append(tabs[:i], append([]*tabpage{t}, tabs[i:]...)...)
+	return t
+}
+
+// enterTab makes t the current tab page
+func enterTab(t *tabpage) {
+	if t == curTab {
+		return
+	}
+	curTab.root, curTab.win = rootFrame, curWin
+	curTab = t
+	rootFrame = t.root
+	enterWindow(t.win)
+	layoutWindows()
+	redraw()
+	refresh(nil)
+}
+
+// closeTab takes t away, refusing when that would leave behind changes
+// not shown in any other tab page unless forced. The buffers stay in the
+// buffer list.
+func closeTab(t *tabpage, force bool) error {
+	if len(tabs) == 1 {
+		return errors.New("cannot close last tab page")
+	}
+	if !force {
+		for _, w := range windowsIn(tabRoot(t)) {
+			if bufferModified(w.buf) && !shownOutside(w.buf, t) {
+				return fmt.Errorf("no write since last change for buffer \"%s\" (add ! to override)", bufferName(w.buf))
+			}
+		}
+	}
+	i := tabIndex(t)
+	if t == curTab {
+		next := i + 1
+		if next == len(tabs) {
+			next = i - 1
+		}
+		enterTab(tabs[next])
+	}
+	tabs = append(tabs[:i], tabs[i+1:]...)
+	layoutWindows()
+	redraw()
+	refresh(nil)
+	return nil
+}
+
+// shownOutside reports whether a window in a tab page other than t shows b
+func shownOutside(b *buffer, t *tabpage) bool {
+	for _, other := range tabs {
+		if other == t {
+			continue
+		}
+		for _, w := range windowsIn(tabRoot(other)) {
+			if w.buf == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cycleTab is gt, going to the next tab page, and gT going to the previous
+// one, wrapping around
+func cycleTab(step int) {
+	i := tabIndex(curTab) + step
+	enterTab(tabs[(i+len(tabs))%len(tabs)])
+}
+
+// exTabedit is :tabnew and :tabedit, opening a tab page on the named file
+// or on a new empty buffer
+func exTabedit(ex *exArgs) error {
+	name, err := expandFileName(ex.arg)
+	if err != nil {
+		return err
+	}
+	var b *buffer
+	if name != "" {
+		b = findFileBuffer(name)
+	}
+	if b == nil {
+		b = newBuffer(name)
+	}
+	enterTab(addTab(b))
+	flash(bufferInfo())
+	return nil
+}
+
+// exTabnext is :tabnext and :tabprevious, or with a number :tabnext N
+// going to that tab page
+func exTabnext(ex *exArgs) error {
+	if ex.cmd.name == "tabnext" && ex.arg != "" {
+		n, err := strconv.Atoi(ex.arg)
+		if err != nil || n < 1 || n > len(tabs) {
+			return fmt.Errorf("invalid argument: %s", ex.arg)
+		}
+		enterTab(tabs[n-1])
+		return nil
+	}
+	if ex.cmd.name == "tabnext" {
+		cycleTab(1)
+	} else {
+		cycleTab(-1)
+	}
+	return nil
+}
+
+func exTabclose(ex *exArgs) error {
+	return closeTab(curTab, ex.bang)
+}
+
+// exTabonly closes every tab page but the current one
+func exTabonly(ex *exArgs) error {
+	for _, t := range append([]*tabpage{}, tabs...) {
+		if t != curTab {
+			if err := closeTab(t, ex.bang); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// drawTabLine draws a label for each tab page across the top row: the
+// number of windows in it if more than one, + if its current buffer has
+// changes, and the buffer's name
+func drawTabLine() {
+	if !showTabLine() {
+		return
+	}
+	move(1, 1)
+	used := 0
+	for _, t := range tabs {
+		w := tabWindow(t)
+		label := " "
+		if n := len(windowsIn(tabRoot(t))); n > 1 {
+			label += strconv.Itoa(n)
+		}
+		if bufferModified(w.buf) {
+			label += "+"
+		}
+		if label != " " {
+			label += " "
+		}
+		label += bufferName(w.buf) + " "
+		if used+len(label) > width {
+			label = label[:max(width-used, 0)]
+		}
+		attr := attrTabLine
+		if t == curTab {
+			attr = attrTabLineSel
+		}
+		paint(attr + label + attrReset)
+		used += len(label)
+	}
+	if used < width {
+		paint(attrTabLineFill + strings.Repeat(" ", width-used) + attrReset)
+	}
+	restore()
+}
@@ -0,0 +1,155 @@
+package main
+
+type undoState struct {
+	lines  []string
+	lineno int
+	textX  int
+	tick   int
+	// marks are where the marks were, by line index, as undo puts lines
+	// back by position rather than as the structs they were
+	marks map[byte]markPos
+}
+
+type markPos struct {
+	n int
+	x int
+}
+
+var undoStack []undoState
+var redoStack []undoState
+
+func snapshot() undoState {
+	marked := map[*line][]byte{}
+	for c, m := range marks {
+		marked[m.l] = append(marked[m.l], c)
+	}
+	positions := map[byte]markPos{}
+	var lines []string
+	for l := top.next; l != nil; l = l.next {
+		for _, c := range marked[l] {
+			positions[c] = markPos{n: len(lines), x: marks[c].x}
+		}
+		lines = append(lines, l.text)
+	}
+	return undoState{lines: lines, lineno: lineno, textX: textX, tick: changeTick, marks: positions}
+}
+
+func sameLines(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// undoGroup is above zero while a command made up of other changes runs,
+// such as :global, so that they are undone together
+var undoGroup int
+
+// saveUndo records the buffer before a change. Commands that end up
+// changing nothing leave a duplicate state behind, which undo skips.
+func saveUndo() {
+	if undoGroup == 0 {
+		undoStack = append(undoStack, snapshot())
+		redoStack = nil
+	}
+	ticks++
+	changeTick = ticks
+}
+
+// dropUndo takes back the saveUndo before a command that changed nothing
+func dropUndo() {
+	if undoGroup > 0 || len(undoStack) == 0 {
+		return
+	}
+	changeTick = undoStack[len(undoStack)-1].tick
+	undoStack = undoStack[:len(undoStack)-1]
+}
+
+// restoreLines puts lines back into the buffer, reusing the existing line
+// structs so pointers into the list stay valid where possible
+func restoreLines(lines []string) {
+	visible := firstVisible()
+	prev := top
+	for _, text := range lines {
+		if prev.next == nil {
+			insertLinesAfter(prev, []string{text})
+		} else {
+			prev.next.text = text
+		}
+		prev = prev.next
+	}
+	prev.next = nil
+	numLines = len(lines)
+	changeLines(0, false, false)
+	if top.next == nil {
+		insertLinesAfter(top, []string{""})
+	}
+	setFirstVisible(visible)
+}
+
+func restoreState(state undoState) {
+	changeTick = state.tick
+	restoreLines(state.lines)
+	for c, pos := range state.marks {
+		setMark(c, nthLine(pos.n), pos.x)
+	}
+	textX = state.textX
+	setCursor(state.lineno)
+	redraw()
+	refresh(nil)
+}
+
+// popChange moves the newest state that differs from the buffer from one
+// stack to the other, returning false when there is none
+func popChange(from *[]undoState, to *[]undoState) bool {
+	current := snapshot()
+	for len(*from) > 0 {
+		state := (*from)[len(*from)-1]
+		*from = (*from)[:len(*from)-1]
+		if sameLines(state.lines, current.lines) {
+			// the change made after it changed nothing
+			current.tick = state.tick
+			changeTick = state.tick
+			continue
+		}
+		*to = append(*to, current)
+		restoreState(state)
+		return true
+	}
+	return false
+}
+
+func undo() {
+	if !popChange(&undoStack, &redoStack) {
+		flash("Already at oldest change")
+	}
+}
+
+func redo() {
+	if !popChange(&redoStack, &undoStack) {
+		flash("Already at newest change")
+	}
+}
+
+// ticks numbers the changes made to any buffer. changeTick is the number
+// of the one that made the buffer what it is, and savedTick the one that
+// had made it match its file.
+var ticks int
+var changeTick int
+var savedTick int
+
+// markSaved records the buffer as matching its file
+func markSaved() {
+	savedTick = changeTick
+}
+
+// isModified reports whether the buffer differs from its file, so that
+// undoing back to the saved text makes it unmodified again
+func isModified() bool {
+	return changeTick != savedTick
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestModified(t *testing.T) {
+	tests := []struct {
+		keys string
+		want bool
+	}{
+		{"x", true},
+		{"xu", false},
+		{"xuu", false},
+		{"xu\x12", true},
+		{"ia\x1b", true},
+		{"i\x1b", false},
+		{"A\x1b", false},
+		{"ia\x7f\x1b", true},
+		{":s/nothing/x/\r", false},
+		{":s/one/two/\r:s/two/one/\r", true},
+		{":s/one/two/\ruu", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.keys, func(t *testing.T) {
+			startEditor([]string{"one", "two"})
+			typeKeys(tt.keys)
+			if got := isModified(); got != tt.want {
+				t.Errorf("isModified() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// visualMode is 'v', 'V' or CTRL_V_CODE while a selection is active
+var visualMode byte
+var visualN int
+var visualX int
+var visualToEnd bool
+
+// visualVcols are the virtual columns the character the selection started
+// on takes, which is what the edges of a block are measured in
+var visualVcols [2]int
+
+type region struct {
+	mode   byte
+	startN int
+	startX int
+	endN   int
+	endX   int
+	toEnd  bool
+	// startV and endV are the first and last virtual column of a block
+	startV int
+	endV   int
+}
+
+// charVcols are the first and last virtual column of the character at
+// byte x of text, or of where it would go past the end
+func charVcols(text string, x int) [2]int {
+	vcol := virtCol(text, x)
+	w := 1
+	if x < len(text) {
+		c, _ := utf8.DecodeRuneInString(text[x:])
+		w = charWidth(c, vcol)
+	}
+	return [2]int{vcol, vcol + w - 1}
+}
+
+func visualRegion() region {
+	r := region{
+		mode:   visualMode,
+		startN: visualN,
+		startX: visualX,
+		endN:   lineno,
+		endX:   textX,
+		toEnd:  visualToEnd,
+	}
+	if r.endN < r.startN || (r.endN == r.startN && r.endX < r.startX) {
+		r.startN, r.endN = r.endN, r.startN
+		r.startX, r.endX = r.endX, r.startX
+	}
+	if r.mode == CTRL_V_CODE {
+		if r.endX < r.startX {
+			r.startX, r.endX = r.endX, r.startX
+		}
+		cur := charVcols(currentLine.text, textX)
+		r.startV = min(visualVcols[0], cur[0])
+		r.endV = max(visualVcols[1], cur[1])
+	}
+	return r
+}
+
+// regionCols is the byte range [a, b) of text, the nth line, covered by r
+func regionCols(r region, n int, text string) (int, int) {
+	a, b := 0, len(text)
+	switch r.mode {
+	case 'v':
+		if n == r.startN {
+			a = r.startX
+		}
+		if n == r.endN {
+			b = r.endX + 1
+		}
+	case CTRL_V_CODE:
+		// a block is columns on the screen, which are not the same bytes
+		// on each line when there are tabs or multibyte characters
+		a = len(text)
+		vcol := 0
+		for i, c := range text {
+			w := charWidth(c, vcol)
+			if vcol+w > r.startV && a == len(text) {
+				a = i
+			}
+			if vcol > r.endV && !r.toEnd {
+				b = i
+				break
+			}
+			vcol += w
+		}
+	}
+	if b > len(text) {
+		b = len(text)
+	}
+	if a > b {
+		a = b
+	}
+	return a, b
+}
+
+func visualHighlights(l *line, n int) []span {
+	if visualMode == 0 {
+		return nil
+	}
+	r := visualRegion()
+	if n < r.startN || n > r.endN {
+		return nil
+	}
+	if len(l.text) == 0 {
+		return []span{{start: 0, end: 1, attr: attrVisual}}
+	}
+	a, b := regionCols(r, n, l.text)
+	return []span{{start: a, end: b, attr: attrVisual}}
+}
+
+func visualBanner() string {
+	switch visualMode {
+	case 'V':
+		return "-- VISUAL LINE --"
+	case CTRL_V_CODE:
+		return "-- VISUAL BLOCK --"
+	default:
+		return "-- VISUAL --"
+	}
+}
+
+func setVisualMarks() {
+	r := visualRegion()
+	setMark('<', nthLine(r.startN), r.startX)
+	setMark('>', nthLine(r.endN), r.endX)
+}
+
+// visual runs visual mode until it is left with escape or an operator is
+// applied to the selection
+func visual(mode byte) {
+	if currentLine == nil {
+		return
+	}
+	visualMode = mode
+	visualN = lineno
+	visualX = textX
+	visualVcols = charVcols(currentLine.text, textX)
+	visualToEnd = false
+	draw()
+
+	for {
+		clearBanner()
+		flash(visualBanner())
+		drawRelativeNumbers()
+		drawStatusLines()
+		c := normalKey()
+		switch c {
+		case ESCAPE_CODE:
+			pendingRegister = 0
+			setVisualMarks()
+			visualMode = 0
+			clearBanner()
+			draw()
+			return
+		case 'v', 'V', CTRL_V_CODE:
+			if c == visualMode {
+				setVisualMarks()
+				visualMode = 0
+				clearBanner()
+				draw()
+				return
+			}
+			visualMode = c
+		case '"':
+			selectRegister()
+			continue
+		case 'o':
+			n, x := visualN, visualX
+			visualN, visualX = lineno, textX
+			visualVcols = charVcols(currentLine.text, textX)
+			oldTop := topOfScreen
+			setCursor(n)
+			textX = x
+			refresh(oldTop)
+		case 'd', 'x', 'y', 'c', 's', '>', '<', '~', 'u', 'U', 'J', ':', 'I', 'A':
+			if strings.IndexByte("dxycs", c) >= 0 && !canStore() {
+				continue
+			}
+			setVisualMarks()
+			r := visualRegion()
+			if r.mode == CTRL_V_CODE {
+				r.startX = textAtVcol(nthLine(r.startN).text, r.startV)
+			}
+			visualMode = 0
+			clearBanner()
+			visualOperator(c, r)
+			return
+		default:
+			if !motion(c) {
+				flash(fmt.Sprintf("unknown command: '%c'", c))
+				continue
+			}
+			visualToEnd = c == '$'
+			setXPos()
+		}
+		draw()
+	}
+}
+
+func regionKind(r region) regKind {
+	switch r.mode {
+	case 'V':
+		return linewise
+	case CTRL_V_CODE:
+		return blockwise
+	default:
+		return charwise
+	}
+}
+
+func regionText(r region) []string {
+	var parts []string
+	n := r.startN
+	for l := nthLine(r.startN); l != nil && n <= r.endN; l = l.next {
+		a, b := regionCols(r, n, l.text)
+		parts = append(parts, l.text[a:b])
+		n++
+	}
+	if takesLineBreak(r) {
+		parts = append(parts, "")
+	}
+	return parts
+}
+
+// takesLineBreak is whether r ends on an empty line, which in vim takes in
+// its line break, so that deleting it joins the next line on
+func takesLineBreak(r region) bool {
+	return r.mode == 'v' && nthLine(r.endN).text == "" && r.endN < lineCount()-1
+}
+
+func visualOperator(c byte, r region) {
+	switch c {
+	case 'y':
+		yankText(regionText(r), regionKind(r))
+		setCursor(r.startN)
+		textX = r.startX
+	case 'd', 'x':
+		saveUndo()
+		deleteText(regionText(r), regionKind(r))
+		deleteRegion(r)
+	case 'c', 's':
+		saveUndo()
+		deleteText(regionText(r), regionKind(r))
+		changeRegion(r)
+		return
+	case '>', '<':
+		saveUndo()
+		dir := 1
+		if c == '<' {
+			dir = -1
+		}
+		n := r.startN
+		for l := nthLine(r.startN); l != nil && n <= r.endN; l = l.next {
+			shiftLine(l, dir)
+			n++
+		}
+		setCursor(r.startN)
+		firstNonBlank()
+	case '~', 'u', 'U':
+		saveUndo()
+		mapRegion(r, c)
+		setCursor(r.startN)
+		textX = r.startX
+	case 'J':
+		saveUndo()
+		count := r.endN - r.startN + 1
+		if count < 2 {
+			count = 2
+		}
+		joinLines(nthLine(r.startN), count)
+		setCursor(r.startN)
+	case ':':
+		redraw()
+		commandWith("'<,'>")
+		return
+	case 'I', 'A':
+		saveUndo()
+		blockInsert(r, c)
+		return
+	}
+	redraw()
+	refresh(nil)
+}
+
+func mapRegion(r region, c byte) {
+	mapping := unicode.ToUpper
+	switch c {
+	case 'u':
+		mapping = unicode.ToLower
+	case '~':
+		mapping = func(ch rune) rune {
+			if unicode.IsUpper(ch) {
+				return unicode.ToLower(ch)
+			}
+			return unicode.ToUpper(ch)
+		}
+	}
+	n := r.startN
+	for l := nthLine(r.startN); l != nil && n <= r.endN; l = l.next {
+		a, b := regionCols(r, n, l.text)
+		l.text = l.text[:a] + strings.Map(mapping, l.text[a:b]) + l.text[b:]
+		n++
+	}
+}
+
+func deleteRegion(r region) {
+	switch r.mode {
+	case 'V':
+		removeLines(r.startN, r.endN)
+		firstNonBlank()
+		return
+	case 'v':
+		first := nthLine(r.startN)
+		last := nthLine(r.endN)
+		a, _ := regionCols(r, r.startN, first.text)
+		_, b := regionCols(r, r.endN, last.text)
+		text := first.text[:a] + last.text[b:]
+		end := r.endN
+		if takesLineBreak(r) {
+			end++
+			text += last.next.text
+		}
+		if end > r.startN {
+			removeLines(r.startN+1, end)
+		}
+		first.text = text
+	default:
+		n := r.startN
+		for l := nthLine(r.startN); l != nil && n <= r.endN; l = l.next {
+			a, b := regionCols(r, n, l.text)
+			l.text = l.text[:a] + l.text[b:]
+			n++
+		}
+	}
+	textX = r.startX
+	setCursor(r.startN)
+}
+
+// startInsertAt enters insert mode with the cursor before byte x of the
+// current line, which may be just past its end
+func startInsertAt(x int) {
+	textX = min(x, len(currentLine.text))
+	insert()
+}
+
+func changeRegion(r region) {
+	switch r.mode {
+	case 'V':
+		first := nthLine(r.startN)
+		if r.endN > r.startN {
+			removeLines(r.startN+1, r.endN)
+		}
+		first.text = ""
+		setCursor(r.startN)
+		redraw()
+		refresh(nil)
+		startInsertAt(0)
+	case 'v':
+		deleteRegion(r)
+		redraw()
+		refresh(nil)
+		startInsertAt(r.startX)
+	default:
+		deleteRegion(r)
+		r.toEnd = false
+		r.endV = r.startV - 1
+		blockInsert(r, 'I')
+	}
+}
+
+// blockInsert inserts text on the first line of r and then repeats it on
+// the others, before the block for I and after it for A
+func blockInsert(r region, c byte) {
+	col := r.startV
+	if c == 'A' {
+		col = r.endV + 1
+	}
+	if r.mode != CTRL_V_CODE {
+		col = 0
+		r.toEnd = c == 'A'
+	}
+
+	first := nthLine(r.startN)
+	x, short := byteAtVcol(first.text, col)
+	if c == 'A' && r.toEnd {
+		x, short = len(first.text), 0
+	}
+	first.text += strings.Repeat(" ", short)
+	x += short
+	before := first.text
+	setCursor(r.startN)
+	redraw()
+	refresh(nil)
+	startInsertAt(x)
+
+	grown := len(first.text) - len(before)
+	if currentLine != first || grown <= 0 || x+grown > len(first.text) ||
+		first.text[:x]+first.text[x+grown:] != before {
+		return
+	}
+	inserted := first.text[x : x+grown]
+
+	n := r.startN + 1
+	for l := first.next; l != nil && n <= r.endN; l = l.next {
+		pos, short := byteAtVcol(l.text, col)
+		if c == 'A' && r.toEnd {
+			pos, short = len(l.text), 0
+		}
+		if short > 0 {
+			if c == 'I' {
+				n++
+				continue
+			}
+			l.text += strings.Repeat(" ", short)
+			pos += short
+		}
+		l.text = l.text[:pos] + inserted + l.text[pos:]
+		n++
+	}
+	redraw()
+	refresh(nil)
+}
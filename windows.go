@@ -0,0 +1,607 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// window is a view onto a buffer, with its own cursor and scroll position.
+// Like buffers, the current window keeps its state in the globals while it
+// is current.
+type window struct {
+	buf   *buffer
+	frame *frame
+
+	topOfScreen *line
+	currentLine *line
+	lineno      int
+	textX       int
+	leftCol     int
+	screenX     int
+	screenY     int
+	topPos      topPosition
+	// lineGen is what the buffer's was when the window was last current
+	lineGen int
+
+	// the text area on the screen, not counting the status line
+	row  int
+	col  int
+	rows int
+	cols int
+}
+
+const (
+	frameLeaf = iota // a single window
+	frameCol         // frames stacked top to bottom
+	frameRow         // frames side by side
+)
+
+// frame is a node of the window layout tree. Its size takes in the status
+// line under each window in it, and for side by side frames the separator
+// columns between them.
+type frame struct {
+	kind     int
+	win      *window
+	parent   *frame
+	children []*frame
+
+	row  int
+	col  int
+	rows int
+	cols int
+}
+
+var rootFrame *frame
+var curWin *window
+
+// winRow and winCol are where the current window's text area starts on the
+// screen, and winRows and winCols its size
+var winRow, winCol, winRows, winCols int
+
+func newWindow(b *buffer) *window {
+	w := &window{buf: b}
+	w.frame = &frame{kind: frameLeaf, win: w}
+	return w
+}
+
+// stash copies the cursor and scroll position of the current window into w
+func (w *window) stash() {
+	w.topOfScreen, w.currentLine = topOfScreen, currentLine
+	w.lineno, w.textX, w.leftCol = lineno, textX, leftCol
+	w.screenX, w.screenY = screenX, screenY
+	w.topPos, w.lineGen = topPos, lineGen
+}
+
+// unstash makes w the window the editor works on. Its buffer must already
+// be the current one.
+func (w *window) unstash() {
+	topOfScreen, currentLine = w.topOfScreen, w.currentLine
+	lineno, textX, leftCol = w.lineno, w.textX, w.leftCol
+	screenX, screenY = w.screenX, w.screenY
+	winRow, winCol, winRows, winCols = w.row, w.col, w.rows, w.cols
+	topPos = w.topPos
+	if w.lineGen != lineGen {
+		fixView()
+	}
+}
+
+// fixView puts the cursor and the screen back on lines that are still in
+// the buffer, in case it was changed through another window
+func fixView() {
+	if top == nil {
+		return
+	}
+	if currentLine != nil {
+		if n := lineIndex(currentLine); n >= 0 {
+			lineno = n
+		}
+	}
+	setCursor(lineno)
+	if topOfScreen == nil || topOfScreen != top && lineIndex(topOfScreen) < 0 {
+		setFirstVisible(lineno)
+	}
+}
+
+// enterWindow makes w the current window
+func enterWindow(w *window) {
+	if w == curWin {
+		return
+	}
+	curWin.stash()
+	curWin = w
+	if w.buf != curBuf {
+		enterBuffer(w.buf) //nolint
+	}
+	w.unstash()
+}
+
+// withWindow runs f with w standing in for the current window
+func withWindow(w *window, f func()) {
+	if w == curWin {
+		f()
+		return
+	}
+	cur := curWin
+	cur.stash()
+	curBuf.stash()
+	curWin, curBuf = w, w.buf
+	w.buf.unstash()
+	w.unstash()
+	f()
+	w.stash()
+	w.buf.stash()
+	curWin, curBuf = cur, cur.buf
+	cur.buf.unstash()
+	cur.unstash()
+}
+
+// windowList is the windows of the current tab page from top left to
+// bottom right
+func windowList() []*window {
+	return windowsIn(rootFrame)
+}
+
+func windowsIn(root *frame) []*window {
+	var list []*window
+	var walk func(f *frame)
+	walk = func(f *frame) {
+		if f.kind == frameLeaf {
+			list = append(list, f.win)
+		}
+		for _, c := range f.children {
+			walk(c)
+		}
+	}
+	walk(root)
+	return list
+}
+
+func windowCount() int {
+	return len(windowList())
+}
+
+// bufferShown reports whether a window other than except, in any tab
+// page, shows b
+func bufferShown(b *buffer, except *window) bool {
+	for _, w := range allWindows() {
+		if w != except && w.buf == b {
+			return true
+		}
+	}
+	return false
+}
+
+// extent is the size of f along the direction frames of kind are laid out
+func (f *frame) extent(kind int) *int {
+	if kind == frameCol {
+		return &f.rows
+	}
+	return &f.cols
+}
+
+// minExtent is the least f can shrink to along the direction of kind
+func (f *frame) minExtent(kind int) int {
+	if f.kind == frameLeaf {
+		if kind == frameCol {
+			return 2
+		}
+		return 1
+	}
+	n := 0
+	for _, c := range f.children {
+		m := c.minExtent(kind)
+		if f.kind != kind {
+			n = max(n, m)
+		} else {
+			n += m
+		}
+	}
+	if f.kind == kind && kind == frameRow {
+		n += len(f.children) - 1
+	}
+	return n
+}
+
+// layoutWindows places the windows on the screen, between the tab line,
+// if there is one, and the message line
+func layoutWindows() {
+	row, rows := 1, 1
+	if height > 2 {
+		rows = height - 1
+	}
+	if showTabLine() && rows > 1 {
+		row, rows = 2, rows-1
+	}
+	placeFrame(rootFrame, row, 1, rows, width)
+	for _, w := range windowList() {
+		f := w.frame
+		w.row, w.col, w.rows, w.cols = f.row, f.col, max(f.rows-1, 1), f.cols
+	}
+	winRow, winCol, winRows, winCols = curWin.row, curWin.col, curWin.rows, curWin.cols
+}
+
+// placeFrame gives f its place on the screen and shares it out among its
+// children, keeping their sizes where they fit and otherwise growing or
+// shrinking them from the last one back
+func placeFrame(f *frame, row int, col int, rows int, cols int) {
+	f.row, f.col, f.rows, f.cols = row, col, rows, cols
+	if f.kind == frameLeaf {
+		return
+	}
+	total := *f.extent(f.kind)
+	if f.kind == frameRow {
+		total -= len(f.children) - 1
+	}
+	sum := 0
+	for _, c := range f.children {
+		sum += *c.extent(f.kind)
+	}
+	diff := total - sum
+	for i := len(f.children) - 1; i >= 0 && diff != 0; i-- {
+		size := f.children[i].extent(f.kind)
+		if diff > 0 {
+			*size += diff
+			diff = 0
+		} else {
+			take := min(-diff, *size-f.children[i].minExtent(f.kind))
+			if take > 0 {
+				*size -= take
+				diff += take
+			}
+		}
+	}
+	for _, c := range f.children {
+		if f.kind == frameCol {
+			placeFrame(c, row, col, c.rows, cols)
+			row += c.rows
+		} else {
+			placeFrame(c, row, col, rows, c.cols)
+			col += c.cols + 1
+		}
+	}
+}
+
+// replaceFrame puts g in the place of f in the layout tree
+func replaceFrame(f *frame, g *frame) {
+	g.parent = f.parent
+	if f.parent == nil {
+		rootFrame = g
+		return
+	}
+	for i, c := range f.parent.children {
+		if c == f {
+			f.parent.children[i] = g
+		}
+	}
+}
+
+// splitWindow opens a new window on the current buffer above the current
+// one, or to the left of it for a vertical split, sharing out its space
+func splitWindow(vertical bool) error {
+	kind := frameCol
+	if vertical {
+		kind = frameRow
+	}
+	f := curWin.frame
+	size := *f.extent(kind)
+	if vertical && size < 3 || !vertical && size < 4 {
+		return errors.New("not enough room")
+	}
+	if f.parent == nil || f.parent.kind != kind {
+		c := &frame{kind: kind, row: f.row, col: f.col, rows: f.rows, cols: f.cols}
+		replaceFrame(f, c)
+		c.children = []*frame{f}
+		f.parent = c
+	}
+
+	curWin.stash()
+	w := newWindow(curBuf)
+	w.stash()
+	nf := w.frame
+	nf.parent = f.parent
+	nf.rows, nf.cols = f.rows, f.cols
+	if vertical {
+		size--
+	}
+	*nf.extent(kind) = size / 2
+	*f.extent(kind) = size - size/2
+	siblings := f.parent.children
+	for i, c := range siblings {
+		if c == f {
+			siblings = append(siblings[:i], append([]*frame{nf}, siblings[i:]...)...)
+			break
+		}
+	}
+	f.parent.children = siblings
+
+	layoutWindows()
+	enterWindow(w)
+	redraw()
+	refresh(nil)
+	return nil
+}
+
+// closeWindow takes w off the screen, giving its space to the window
+// before it, or after it if it is the first. Its buffer stays in the
+// buffer list with any changes. Closing the last window of a tab page
+// closes the tab page.
+func closeWindow(w *window) error {
+	f := w.frame
+	p := f.parent
+	if p == nil && len(tabs) > 1 {
+		return closeTab(curTab, true)
+	}
+	if p == nil {
+		return errors.New("cannot close last window")
+	}
+	i := 0
+	for p.children[i] != f {
+		i++
+	}
+	p.children = append(p.children[:i], p.children[i+1:]...)
+	gainer := p.children[max(i-1, 0)]
+	*gainer.extent(p.kind) += *f.extent(p.kind)
+	if p.kind == frameRow {
+		*gainer.extent(p.kind)++
+	}
+
+	if len(p.children) == 1 {
+		// a frame holding a single frame gives way to it
+		only := p.children[0]
+		only.rows, only.cols = p.rows, p.cols
+		g := p.parent
+		replaceFrame(p, only)
+		if g != nil && only.kind == g.kind {
+			var children []*frame
+			for _, c := range g.children {
+				if c == only {
+					for _, oc := range only.children {
+						oc.parent = g
+					}
+					children = append(children, only.children...)
+				} else {
+					children = append(children, c)
+				}
+			}
+			g.children = children
+		}
+	}
+
+	if w == curWin {
+		next := gainer
+		for next.kind != frameLeaf {
+			next = next.children[0]
+		}
+		enterWindow(next.win)
+	}
+	layoutWindows()
+	redraw()
+	refresh(nil)
+	return nil
+}
+
+// onlyWindow closes every window but the current one
+func onlyWindow() {
+	for _, w := range windowList() {
+		if w != curWin {
+			closeWindow(w) //nolint
+		}
+	}
+}
+
+// resizeWindow makes the current window taller, or wider for a vertical
+// change, by delta, or smaller if it is negative, at the expense of the
+// windows next to it
+func resizeWindow(vertical bool, delta int) {
+	kind := frameCol
+	if vertical {
+		kind = frameRow
+	}
+	f := curWin.frame
+	for f.parent != nil && f.parent.kind != kind {
+		f = f.parent
+	}
+	if f.parent == nil {
+		return
+	}
+	siblings := f.parent.children
+	i := 0
+	for siblings[i] != f {
+		i++
+	}
+	if delta < 0 {
+		delta = -min(-delta, *f.extent(kind)-f.minExtent(kind))
+		other := i + 1
+		if other == len(siblings) {
+			other = i - 1
+		}
+		*siblings[other].extent(kind) -= delta
+		*f.extent(kind) += delta
+	} else {
+		// take from the frames after it first, then the nearest before it
+		order := append([]*frame{}, siblings[i+1:]...)
+		for j := i - 1; j >= 0; j-- {
+			order = append(order, siblings[j])
+		}
+		got := 0
+		for _, s := range order {
+			take := min(delta-got, *s.extent(kind)-s.minExtent(kind))
+			if take > 0 {
+				*s.extent(kind) -= take
+				got += take
+			}
+		}
+		*f.extent(kind) += got
+	}
+	layoutWindows()
+	redraw()
+	refresh(nil)
+}
+
+// equalizeWindows makes the frames in each part of the layout the same size
+func equalizeWindows() {
+	var even func(f *frame)
+	even = func(f *frame) {
+		if f.kind == frameLeaf {
+			return
+		}
+		total := *f.extent(f.kind)
+		if f.kind == frameRow {
+			total -= len(f.children) - 1
+		}
+		n := len(f.children)
+		for i, c := range f.children {
+			*c.extent(f.kind) = total / n
+			if i < total%n {
+				*c.extent(f.kind)++
+			}
+			even(c)
+		}
+	}
+	even(rootFrame)
+	layoutWindows()
+	redraw()
+	refresh(nil)
+}
+
+// neighbourWindow finds the window next to the current one in the
+// direction of h, j, k or l, nearest the cursor
+func neighbourWindow(dir byte) *window {
+	f := curWin.frame
+	x := min(winCol+screenX-1, f.col+f.cols-1)
+	y := winRow + screenY - 1
+	switch dir {
+	case 'h':
+		x = f.col - 2
+	case 'l':
+		x = f.col + f.cols + 1
+	case 'k':
+		y = f.row - 1
+	case 'j':
+		y = f.row + f.rows
+	}
+	for _, w := range windowList() {
+		g := w.frame
+		if w != curWin && x >= g.col && x < g.col+g.cols && y >= g.row && y < g.row+g.rows {
+			return w
+		}
+	}
+	return nil
+}
+
+// cycleWindow goes to the next window, or the previous one for a
+// negative step, wrapping around
+func cycleWindow(step int) {
+	list := windowList()
+	for i, w := range list {
+		if w == curWin {
+			enterWindow(list[(i+step+len(list))%len(list)])
+			break
+		}
+	}
+}
+
+// windowCommand is Ctrl-W followed by the window command to run
+func windowCommand() {
+	c := getchar()
+	if c >= 1 && c <= 26 && c != CTRL_C_CODE && c != ENTER_CODE {
+		c += 'a' - 1 // Ctrl-W Ctrl-J is Ctrl-W j, and so on
+	}
+	old := curWin
+	switch c {
+	case 'h', 'j', 'k', 'l':
+		if w := neighbourWindow(c); w != nil {
+			enterWindow(w)
+		}
+	case 'w':
+		cycleWindow(1)
+	case 'W':
+		cycleWindow(-1)
+	case 's', 'S':
+		execute("split")
+	case 'v':
+		execute("vsplit")
+	case 'c':
+		execute("close")
+	case 'q':
+		execute("quit")
+	case 'o':
+		execute("only")
+	case '=':
+		equalizeWindows()
+	case '+':
+		resizeWindow(false, 1)
+	case '-':
+		resizeWindow(false, -1)
+	case '>':
+		resizeWindow(true, 1)
+	case '<':
+		resizeWindow(true, -1)
+	case ESCAPE_CODE, CTRL_C_CODE:
+	default:
+		flash(fmt.Sprintf("unknown command: '^W%c'", c))
+	}
+	if curWin != old {
+		drawStatusLines()
+		refresh(topOfScreen)
+	}
+}
+
+// exSplit is :split and :vsplit, either of which can open a file in the
+// new window
+func exSplit(ex *exArgs) error {
+	if err := splitWindow(ex.cmd.name == "vsplit"); err != nil {
+		return err
+	}
+	if ex.arg == "" {
+		return nil
+	}
+	name, err := expandFileName(ex.arg)
+	if err != nil {
+		return err
+	}
+	return editFile(name, false)
+}
+
+func exClose(ex *exArgs) error {
+	return closeWindow(curWin)
+}
+
+func exOnly(ex *exArgs) error {
+	onlyWindow()
+	return nil
+}
+
+// drawWindows draws every window with its status line and the separators
+// between side by side windows
+func drawWindows() {
+	drawTabLine()
+	for _, w := range windowList() {
+		withWindow(w, draw)
+	}
+	drawSeparators(rootFrame)
+	drawStatusLines()
+}
+
+// drawOtherWindows redraws the windows that show the current buffer as
+// well, to keep them up with changes made in this one
+func drawOtherWindows() {
+	for _, w := range windowList() {
+		if w != curWin && w.buf == curBuf {
+			withWindow(w, draw)
+		}
+	}
+}
+
+func drawSeparators(f *frame) {
+	for i, c := range f.children {
+		if f.kind == frameRow && i < len(f.children)-1 {
+			for y := c.row; y < c.row+c.rows; y++ {
+				move(c.col+c.cols, y)
+				paint(attrStatusNC + "|" + attrReset)
+			}
+		}
+		drawSeparators(c)
+	}
+	restore()
+}
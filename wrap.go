@@ -0,0 +1,449 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// leftCol is the first virtual column the current window shows with
+// 'nowrap', when it is scrolled sideways
+var leftCol int
+
+// segment is the part of a line shown on one screen row: bytes start to
+// end, the first of them at virtual column vcol
+type segment struct {
+	start int
+	end   int
+	vcol  int
+}
+
+// charWidth is how many columns c takes at virtual column vcol
+func charWidth(c rune, vcol int) int {
+	if c == '\t' {
+		return tabStop() - vcol%tabStop()
+	}
+	return 1
+}
+
+// virtCol is the virtual column byte x of text starts at, counting tabs
+// out to their tab stops. Past the end it is the width of the whole line.
+func virtCol(text string, x int) int {
+	vcol := 0
+	for i, c := range text {
+		if i >= x {
+			break
+		}
+		vcol += charWidth(c, vcol)
+	}
+	return vcol
+}
+
+// textAtVcol is the byte of text covering virtual column want, or the
+// last character if the line ends before it
+func textAtVcol(text string, want int) int {
+	vcol, last := 0, 0
+	for i, c := range text {
+		last = i
+		vcol += charWidth(c, vcol)
+		if vcol > want {
+			return i
+		}
+	}
+	return last
+}
+
+// byteAtVcol is the first byte of text at or after virtual column want,
+// and how many columns short of it the line ends
+func byteAtVcol(text string, want int) (int, int) {
+	vcol := 0
+	for i, c := range text {
+		if vcol >= want {
+			return i, 0
+		}
+		vcol += charWidth(c, vcol)
+	}
+	return len(text), max(want-vcol, 0)
+}
+
+// showbreak is what continuation rows of a wrapped line start with,
+// unless it would leave no room for the text
+func showbreak() string {
+	sbr := optString("showbreak")
+	if utf8.RuneCountInString(sbr) >= textCols() {
+		return ""
+	}
+	return sbr
+}
+
+func breakAt() string {
+	return strings.ReplaceAll(optString("breakat"), "^I", "\t")
+}
+
+// segments splits text into the rows it takes in the current window. With
+// 'nowrap' that is always a single row. With 'linebreak' rows end after
+// one of the 'breakat' characters rather than in the middle of a word.
+func segments(text string) []segment {
+	if !optBool("wrap") {
+		return []segment{{start: 0, end: len(text)}}
+	}
+	cols := textCols()
+	contCols := cols - utf8.RuneCountInString(showbreak())
+	linebreak, breaks := optBool("linebreak"), breakAt()
+	segs := []segment{{}}
+	rowCols := cols
+	vcol := 0
+	brk, brkVcol := -1, 0
+	for i, c := range text {
+		w := charWidth(c, vcol)
+		cur := &segs[len(segs)-1]
+		if vcol+w-cur.vcol > rowCols && i > cur.start {
+			cut, cutVcol := i, vcol
+			if linebreak && brk > cur.start {
+				cut, cutVcol = brk, brkVcol
+			}
+			cur.end = cut
+			segs = append(segs, segment{start: cut, vcol: cutVcol})
+			rowCols = contCols
+			brk = -1
+		}
+		if linebreak && strings.ContainsRune(breaks, c) {
+			brk, brkVcol = i+utf8.RuneLen(c), vcol+w
+		}
+		vcol += w
+	}
+	segs[len(segs)-1].end = len(text)
+	return segs
+}
+
+// segmentAt is the index of the segment byte x is in
+func segmentAt(segs []segment, x int) int {
+	i := 0
+	for i+1 < len(segs) && segs[i+1].start <= x {
+		i++
+	}
+	return i
+}
+
+// prefixWidth is the width of what segment i of a line starts with
+func prefixWidth(i int) int {
+	if i == 0 {
+		return 0
+	}
+	return utf8.RuneCountInString(showbreak())
+}
+
+// lineRows is how many screen rows text takes in the current window
+func lineRows(text string) int {
+	if !optBool("wrap") {
+		return 1
+	}
+	return len(segments(text))
+}
+
+// lineRow is the window row line n starts on, for a line on the screen
+func lineRow(n int) int {
+	first := firstVisible()
+	if !optBool("wrap") {
+		return n - first + 1
+	}
+	row := 1
+	l := topOfScreen.next
+	for i := first; i < n && l != nil; i++ {
+		row += lineRows(l.text)
+		l = l.next
+	}
+	return row
+}
+
+// screenRow is the window row l starts on, or 0 if it is not on the
+// screen. Unlike lineRow it only looks at the lines on the screen.
+func screenRow(l *line) int {
+	row := 1
+	for s := topOfScreen.next; s != nil && row <= textRows(); s = s.next {
+		if s == l {
+			return row
+		}
+		row += lineRows(s.text)
+	}
+	return 0
+}
+
+// cursorInView finds the row the cursor line starts on, with dir 0 when
+// it is on the screen with 'scrolloff' lines around it, or -1 or 1 when
+// the screen has to move up or down to it. It only looks at the lines
+// around the screen, so it is cheap however long the buffer is, and gives
+// row 0 and dir 0 when the cursor is further away than that.
+func cursorInView() (row int, dir int) {
+	so := scrollOff()
+	row = screenRow(currentLine)
+	if row == 0 {
+		up, down := topOfScreen, topOfScreen.next
+		for i := 0; i < 2*textRows(); i++ {
+			if up == currentLine {
+				return 0, -1
+			}
+			if down == currentLine {
+				return 0, 1
+			}
+			if up != top {
+				up = up.prev
+			}
+			if down != nil {
+				down = down.next
+			}
+		}
+		return 0, 0
+	}
+	above := 0
+	for l := topOfScreen.next; l != currentLine; l = l.next {
+		above++
+	}
+	if above < so && topOfScreen != top {
+		return row, -1
+	}
+	bottom := row - 1
+	l := currentLine
+	for i := 0; i <= so && l != nil; i++ {
+		bottom += lineRows(l.text)
+		l = l.next
+	}
+	if bottom > textRows() {
+		return row, 1
+	}
+	return row, 0
+}
+
+// scrollTowardsCursor scrolls a line at a time until the cursor line is
+// in view, as it is after j or k have taken it just off the screen. It
+// gives up after a screenful, returning false.
+func scrollTowardsCursor() (int, bool) {
+	for i := 0; i <= textRows(); i++ {
+		row, dir := cursorInView()
+		switch {
+		case dir == 0 && row > 0:
+			return row, true
+		case dir < 0 && topOfScreen != top:
+			setTop(topOfScreen.prev, topIndex()-1)
+		case dir > 0 && topOfScreen.next != currentLine:
+			setTop(topOfScreen.next, topIndex()+1)
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// lineAbove is the line that starts up to rows screen rows above line n,
+// without going past the first line
+func lineAbove(n int, rows int) int {
+	if n < 0 {
+		return 0
+	}
+	if !optBool("wrap") {
+		return max(n-rows, 0)
+	}
+	l := nthLine(n)
+	for l.prev != top {
+		r := lineRows(l.prev.text)
+		if r > rows {
+			break
+		}
+		rows -= r
+		n--
+		l = l.prev
+	}
+	return n
+}
+
+// topLineFor is the first line to show for line last to be wholly on the
+// bottom rows of the window
+func topLineFor(last int) int {
+	if last < 0 {
+		return 0
+	}
+	return lineAbove(last, textRows()-lineRows(nthLine(last).text))
+}
+
+// displayPart shows bytes start to end of line on row y of the current
+// window, after prefix. The first of them is at virtual column vcol and
+// the row shows from virtual column skip on.
+func displayPart(line string, y int, spans []span, start int, end int, vcol int, skip int, prefix string) {
+	cols := textCols()
+	move(textCol(), winRow+y-1)
+	out := 0
+	if prefix != "" {
+		paint(attrNonText + prefix + attrReset)
+		out = utf8.RuneCountInString(prefix)
+	}
+	for i, c := range line[start:end] {
+		w := charWidth(c, vcol)
+		visible := w
+		if vcol < skip {
+			visible = vcol + w - skip
+		}
+		vcol += w
+		if visible <= 0 {
+			continue
+		}
+		if out >= cols {
+			break
+		}
+		visible = min(visible, cols-out)
+		attr := spanAttr(spans, start+i)
+		if attr != "" {
+			paint(attr)
+		}
+		if c == '\t' || visible < w {
+			paint(strings.Repeat(" ", visible))
+		} else {
+			paint(string(c))
+		}
+		if attr != "" {
+			paint(attrReset)
+		}
+		out += visible
+	}
+	if attr := spanAttr(spans, len(line)); attr != "" && end == len(line) && out < cols {
+		paint(attr + " " + attrReset)
+		out++
+	}
+	if out < cols {
+		paint(strings.Repeat(" ", cols-out))
+	}
+}
+
+// drawLine draws l, the nth line, from row y of the current window down
+func drawLine(l *line, n int, y int) {
+	spans := lineHighlights(l, n)
+	if !optBool("wrap") {
+		drawGutter(y, n)
+		displayPart(l.text, y, spans, 0, len(l.text), 0, leftCol, "")
+		return
+	}
+	for i, seg := range segments(l.text) {
+		if y+i > textRows() {
+			break
+		}
+		prefix := ""
+		if i == 0 {
+			drawGutter(y, n)
+		} else {
+			drawGutter(y+i, -1)
+			prefix = showbreak()
+		}
+		displayPart(l.text, y+i, spans, seg.start, seg.end, seg.vcol, seg.vcol, prefix)
+	}
+}
+
+// drawCutLine marks row y as holding part of a line too long to show
+func drawCutLine(y int) {
+	move(winCol, winRow+y-1)
+	paint(attrNonText + "@" + attrReset + strings.Repeat(" ", max(winCols-1, 0)))
+}
+
+// scrollSideways scrolls the current window with 'nowrap' so that virtual
+// column vcol is on it, at least 'sidescrolloff' columns from the edges.
+// With 'sidescroll' at 0 the cursor goes to the middle of the window, and
+// otherwise the window moves at least that many columns.
+func scrollSideways(vcol int) {
+	cols := textCols()
+	so := min(optNumber("sidescrolloff"), (cols-1)/2)
+	step := optNumber("sidescroll")
+	old := leftCol
+	switch {
+	case vcol < leftCol+so && leftCol > 0:
+		if step == 0 {
+			leftCol = vcol - cols/2
+		} else {
+			leftCol = min(vcol-so, leftCol-step)
+		}
+	case vcol >= leftCol+cols-so:
+		if step == 0 {
+			leftCol = vcol - cols/2
+		} else {
+			leftCol = max(vcol-cols+so+1, leftCol+step)
+		}
+	}
+	leftCol = max(leftCol, 0)
+	if leftCol != old {
+		draw()
+	}
+}
+
+// sideScroll is zh and zl, scrolling a column left or right, zH and zL
+// scrolling half a screen, and zs and ze, which put the cursor at the
+// start or the end of the screen. The cursor is dragged along when it
+// would go off the screen.
+func sideScroll(c byte) {
+	if optBool("wrap") || currentLine == nil {
+		return
+	}
+	text := currentLine.text
+	cols := textCols()
+	so := min(optNumber("sidescrolloff"), (cols-1)/2)
+	vcol := virtCol(text, textX)
+	switch c {
+	case 'h':
+		leftCol--
+	case 'l':
+		leftCol++
+	case 'H':
+		leftCol -= cols / 2
+	case 'L':
+		leftCol += cols / 2
+	case 's':
+		leftCol = vcol - so
+	case 'e':
+		leftCol = vcol - cols + 1 + so
+	}
+	leftCol = max(leftCol, 0)
+	if vcol < leftCol+so {
+		textX = textAtVcol(text, leftCol+so)
+	} else if vcol > leftCol+cols-1-so {
+		textX = textAtVcol(text, leftCol+cols-1-so)
+	}
+	draw()
+	setXPos()
+	restore()
+}
+
+// displayLineMove is gj and gk, which move down or up a screen row
+// rather than a line, staying in the same line when it wraps
+func displayLineMove(dir int) {
+	if currentLine == nil {
+		return
+	}
+	if !optBool("wrap") {
+		if dir > 0 {
+			down()
+		} else {
+			up()
+		}
+		return
+	}
+	segs := segments(currentLine.text)
+	i := segmentAt(segs, textX)
+	col := virtCol(currentLine.text, textX) - segs[i].vcol + prefixWidth(i)
+	n, target := lineno, i+dir
+	if target < 0 {
+		if lineno == 0 {
+			return
+		}
+		n--
+		segs = segments(nthLine(n).text)
+		target = len(segs) - 1
+	} else if target >= len(segs) {
+		if lineno == lineCount()-1 {
+			return
+		}
+		n++
+		segs = segments(nthLine(n).text)
+		target = 0
+	}
+	seg := segs[target]
+	x := textAtVcol(nthLine(n).text, seg.vcol+max(col-prefixWidth(target), 0))
+	oldTop := topOfScreen
+	textX = min(max(x, seg.start), max(seg.end-1, seg.start))
+	setCursor(n)
+	refresh(oldTop)
+}